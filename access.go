@@ -0,0 +1,31 @@
+package sqlitefs
+
+import (
+	"database/sql"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// startAccess begins recording when files were last opened in the
+// last_accessed column, adding the column to older databases.
+func (s *SQLiteFS) startAccess(db *sql.DB, logger *zap.Logger) error {
+	if err := addColumn(db, "files", "last_accessed", "INTEGER"); err != nil {
+		return err
+	}
+	s.access = newBatcher(time.Duration(s.FlushInterval),
+		func(old, v int64) int64 { return max(old, v) },
+		func(pending map[string]int64) error {
+			return withTx(db, func(tx *sql.Tx) error {
+				for name, ts := range pending {
+					if _, err := tx.Exec("UPDATE files SET last_accessed=? WHERE name=?", ts, name); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+		func(err error) { logger.Error("recording last access", zap.Error(err)) },
+	)
+	return nil
+}
@@ -0,0 +1,371 @@
+package sqlitefs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// instances holds the provisioned file systems by db_path so the admin API
+// can reach them.
+var (
+	instancesMu sync.RWMutex
+	instances   = make(map[string]*SQLiteFS)
+)
+
+func registerInstance(s *SQLiteFS) {
+	instancesMu.Lock()
+	instances[s.DBPath] = s
+	instancesMu.Unlock()
+}
+
+func unregisterInstance(s *SQLiteFS) {
+	instancesMu.Lock()
+	if instances[s.DBPath] == s {
+		delete(instances, s.DBPath)
+	}
+	instancesMu.Unlock()
+}
+
+func lookupInstance(dbPath string) (*SQLiteFS, error) {
+	instancesMu.RLock()
+	defer instancesMu.RUnlock()
+	if dbPath == "" && len(instances) == 1 {
+		for _, s := range instances {
+			return s, nil
+		}
+	}
+	s, ok := instances[dbPath]
+	if !ok {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no sqlite file system with db_path %q", dbPath),
+		}
+	}
+	return s, nil
+}
+
+// AdminAPI exposes the sqlite file systems on the admin endpoint.
+type AdminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.sqlitefs",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/sqlitefs/analytics", Handler: caddy.AdminHandlerFunc(a.handleAnalytics)},
+		{Pattern: "/sqlitefs/bandwidth", Handler: caddy.AdminHandlerFunc(a.handleBandwidth)},
+		{Pattern: "/sqlitefs/dataset", Handler: caddy.AdminHandlerFunc(a.handleDataset)},
+		{Pattern: "/sqlitefs/deleted", Handler: caddy.AdminHandlerFunc(a.handleDeleted)},
+		{Pattern: "/sqlitefs/files", Handler: caddy.AdminHandlerFunc(a.handleFiles)},
+		{Pattern: "/sqlitefs/restore", Handler: caddy.AdminHandlerFunc(a.handleRestore)},
+	}
+}
+
+// handleBandwidth reports bytes served per accounting prefix. Query
+// parameters: db (the db_path, optional with a single instance) and since
+// (a duration, default 24h).
+func (AdminAPI) handleBandwidth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	s, err := lookupInstance(r.URL.Query().Get("db"))
+	if err != nil {
+		return err
+	}
+	if s.bandwidth == nil {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("bandwidth accounting is not enabled for %s", s.DBPath)}
+	}
+	since, err := parseSince(r)
+	if err != nil {
+		return err
+	}
+	usage, err := s.bandwidthSince(time.Now().Add(-since))
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(usage)
+}
+
+// handleAnalytics reports the most opened and most missed files and the
+// bytes served per content type, from the hits and misses tables. Query
+// parameters: db, since (default 24h) and limit (names per list, default 20).
+func (AdminAPI) handleAnalytics(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	s, err := lookupInstance(r.URL.Query().Get("db"))
+	if err != nil {
+		return err
+	}
+	if s.hits == nil {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("hit tracking is not enabled for %s", s.DBPath)}
+	}
+	since, err := parseSince(r)
+	if err != nil {
+		return err
+	}
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("limit must be a positive number, got %q", v)}
+		}
+	}
+	report, err := s.analyticsSince(time.Now().Add(-since), limit)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(report)
+}
+
+// handleDataset reports the active dataset label on GET and switches it to
+// the label parameter on POST.
+func (AdminAPI) handleDataset(w http.ResponseWriter, r *http.Request) error {
+	s, err := lookupInstance(r.URL.Query().Get("db"))
+	if err != nil {
+		return err
+	}
+	if !s.columns["dataset"] {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("files table of %s has no dataset column", s.DBPath)}
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		s.dataset.Store(r.URL.Query().Get("label"))
+	default:
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]string{"dataset": s.activeDataset()})
+}
+
+// handleDeleted lists soft deleted files with the time of deletion.
+func (AdminAPI) handleDeleted(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	s, err := softDeleting(r)
+	if err != nil {
+		return err
+	}
+	deleted, err := s.listDeleted(r.Context())
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(deleted)
+}
+
+// handleRestore undoes the soft delete of the file in the name parameter.
+func (AdminAPI) handleRestore(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	s, err := softDeleting(r)
+	if err != nil {
+		return err
+	}
+	name := r.URL.Query().Get("name")
+	if err := s.restore(r.Context(), name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("%s is not deleted", name)}
+		}
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleFiles reads, writes and deletes the file in the name parameter: GET
+// serves it, PUT stores the request body as its content and DELETE removes
+// it, honoring If-Match. Without name, GET lists the directory in the dir
+// parameter (default "."). Other query parameters: db, tenant (for tables
+// with tenant_column), and for PUT mode (octal), modified and expires (unix
+// timestamps) and variant.
+func (AdminAPI) handleFiles(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	s, err := lookupInstance(q.Get("db"))
+	if err != nil {
+		return err
+	}
+	ctx := r.Context()
+	if q.Has("tenant") {
+		ctx = WithTenant(ctx, q.Get("tenant"))
+	}
+	name := q.Get("name")
+	if name == "" && r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("name is required")}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if name == "" {
+			dir := q.Get("dir")
+			if dir == "" {
+				dir = "."
+			}
+			entries, err := s.ReadDirContext(ctx, dir)
+			if err != nil {
+				return writeErrorStatus(err)
+			}
+			list := make([]fileEntry, len(entries))
+			for i, e := range entries {
+				info, err := e.Info()
+				if err != nil {
+					return writeErrorStatus(err)
+				}
+				list[i] = fileEntry{Name: path.Join(dir, e.Name()), Size: info.Size(), Mode: info.Mode().String(), Modified: info.ModTime(), Dir: e.IsDir()}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			return json.NewEncoder(w).Encode(list)
+		}
+		f, err := s.OpenContext(ctx, name)
+		if err != nil {
+			return writeErrorStatus(err)
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return writeErrorStatus(err)
+		}
+		rs, ok := f.(io.ReadSeeker)
+		if !ok || info.IsDir() {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("%s is a directory", name)}
+		}
+		if fi, ok := info.(sqliteFileInfo); ok && fi.etag() != "" {
+			w.Header().Set("Etag", fi.etag())
+		}
+		http.ServeContent(w, r, info.Name(), info.ModTime(), rs)
+		return nil
+
+	case http.MethodPut:
+		opts := WriteOptions{IfMatch: r.Header.Get("If-Match"), Variant: q.Get("variant"), ContentType: q.Get("content_type")}
+		if v := q.Get("mode"); v != "" {
+			mode, err := strconv.ParseUint(v, 8, 32)
+			if err != nil {
+				return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("parsing mode: %v", err)}
+			}
+			opts.Mode = fs.FileMode(mode)
+		}
+		for param, t := range map[string]*time.Time{"modified": &opts.Modified, "expires": &opts.ExpiredAt} {
+			if v := q.Get(param); v != "" {
+				ts, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("parsing %s: %v", param, err)}
+				}
+				*t = time.Unix(ts, 0)
+			}
+		}
+		body := io.Reader(r.Body)
+		if p := s.UploadPolicy; p != nil && p.MaxSize > 0 {
+			// enough to tell it's too large
+			body = io.LimitReader(body, p.MaxSize+1)
+		}
+		content, err := io.ReadAll(body)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("reading content: %v", err)}
+		}
+		etag, err := s.WriteFileContext(ctx, name, content, opts)
+		if err != nil {
+			return writeErrorStatus(err)
+		}
+		w.Header().Set("Etag", etag)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	case http.MethodDelete:
+		if err := s.RemoveContext(ctx, name, r.Header.Get("If-Match")); err != nil {
+			return writeErrorStatus(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	default:
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+}
+
+// fileEntry is a directory entry listed by the files endpoint.
+type fileEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	Modified time.Time `json:"modified"`
+	Dir      bool      `json:"dir,omitempty"`
+}
+
+// writeErrorStatus maps an error of the files endpoint to an API error.
+func writeErrorStatus(err error) error {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrPreconditionFailed):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, ErrPreconditionRequired):
+		status = http.StatusPreconditionRequired
+	case errors.Is(err, ErrQuotaExceeded):
+		status = http.StatusInsufficientStorage
+	case errors.Is(err, ErrRejected):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, ErrTooManyRequests):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, fs.ErrInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, fs.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		status = http.StatusForbidden
+	}
+	return caddy.APIError{HTTPStatus: status, Err: err}
+}
+
+// softDeleting looks up the instance of the request, which must support
+// soft deletes.
+func softDeleting(r *http.Request) (*SQLiteFS, error) {
+	s, err := lookupInstance(r.URL.Query().Get("db"))
+	if err != nil {
+		return nil, err
+	}
+	if !s.columns["deleted_at"] {
+		return nil, caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("files table of %s has no deleted_at column", s.DBPath)}
+	}
+	return s, nil
+}
+
+// parseSince reads the since query parameter as a duration.
+func parseSince(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("since")
+	if v == "" {
+		return 24 * time.Hour, nil
+	}
+	d, err := caddy.ParseDuration(v)
+	if err != nil {
+		return 0, caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("parsing since: %v", err)}
+	}
+	return d, nil
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
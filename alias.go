@@ -0,0 +1,58 @@
+package sqlitefs
+
+import (
+	"context"
+)
+
+// maxAliasHops bounds alias chains, which also stops alias loops.
+const maxAliasHops = 8
+
+// resolveAlias returns the target of name in the aliases table.
+func (s SQLiteFS) resolveAlias(ctx context.Context, name string, hops int) (string, bool) {
+	if !s.aliases || hops >= maxAliasHops {
+		return "", false
+	}
+	var target string
+	err := s.db.QueryRowContext(ctx, "SELECT target FROM aliases WHERE alias=?", name).Scan(&target)
+	if err != nil || target == name || !s.withinRoot(target) {
+		return "", false
+	}
+	return target, true
+}
+
+// canonicalLookup looks up name reached through another name, marking it
+// as the canonical one.
+func (s SQLiteFS) canonicalLookup(ctx context.Context, name string, hops int) (*fileRow, error) {
+	row, err := s.lookup(ctx, name, hops)
+	if err != nil {
+		return nil, err
+	}
+	if row.info.canonical == "" {
+		row.info.canonical = row.info.name
+	}
+	return row, nil
+}
+
+// resolveCase returns the stored spelling of a requested name when it only
+// differs in case, if CaseInsensitive is enabled, or in what Collation
+// ignores.
+func (s SQLiteFS) resolveCase(ctx context.Context, name string, hops int, filter string, args []any) (string, bool) {
+	if hops > 0 {
+		return "", false
+	}
+	var collation string
+	switch c := s.Collation; {
+	case c != nil && (c.IgnoreCase || c.IgnoreDiacritics):
+		collation = c.sqlName()
+	case s.CaseInsensitive:
+		collation = "NOCASE"
+	default:
+		return "", false
+	}
+	var stored string
+	err := s.db.QueryRowContext(ctx, "SELECT name FROM files WHERE name=? COLLATE "+collation+" AND "+filter+" LIMIT 1", append([]any{name}, args...)...).Scan(&stored)
+	if err != nil || stored == name || !s.withinRoot(stored) {
+		return "", false
+	}
+	return stored, true
+}
@@ -0,0 +1,134 @@
+package sqlitefs
+
+import (
+	"database/sql"
+	"fmt"
+	"mime"
+	"path"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const missesSchema = `
+CREATE TABLE IF NOT EXISTS "misses" (
+	"name" TEXT,
+	"hour" INTEGER, -- unix timestamp of the start of the hour
+	"count" INTEGER,
+	PRIMARY KEY ("name", "hour")
+) WITHOUT ROWID;
+`
+
+// startMisses begins counting lookups of names that don't exist into the
+// misses table.
+func (s *SQLiteFS) startMisses(db *sql.DB, logger *zap.Logger) error {
+	if _, err := db.Exec(missesSchema); err != nil {
+		return fmt.Errorf("creating misses table: %w", err)
+	}
+	s.misses = newBatcher(time.Duration(s.FlushInterval),
+		func(old, v int64) int64 { return old + v },
+		func(pending map[string]int64) error {
+			return withTx(db, func(tx *sql.Tx) error {
+				hour := time.Now().Truncate(time.Hour).Unix()
+				for name, n := range pending {
+					_, err := tx.Exec(`INSERT INTO misses (name, hour, count) VALUES (?, ?, ?)
+						ON CONFLICT(name, hour) DO UPDATE SET count=count+excluded.count`, name, hour, n)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+		func(err error) { logger.Error("recording misses", zap.Error(err)) },
+	)
+	return nil
+}
+
+// analytics is the serving statistics report.
+type analytics struct {
+	Since       time.Time   `json:"since"`
+	TopPaths    []nameCount `json:"top_paths"`
+	Misses      []nameCount `json:"misses"`
+	BytesByType []typeBytes `json:"bytes_by_type"`
+}
+
+type nameCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+type typeBytes struct {
+	Type  string `json:"type"`
+	Bytes int64  `json:"bytes"`
+}
+
+// analyticsSince aggregates the hits and misses tables since t, listing
+// the limit most frequent names. Bytes by type count every hit as the
+// whole current file, without ranges or cached responses.
+func (s *SQLiteFS) analyticsSince(t time.Time, limit int) (*analytics, error) {
+	hour := t.Truncate(time.Hour).Unix()
+	report := &analytics{Since: time.Unix(hour, 0)}
+	var err error
+	report.TopPaths, err = s.topNames("hits", hour, limit)
+	if err != nil {
+		return nil, err
+	}
+	report.Misses, err = s.topNames("misses", hour, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.wdb.Query(`SELECT name, sum(count) * (SELECT max(`+s.sizeColumn()+`) FROM files WHERE files.name=hits.name)
+		FROM hits WHERE hour >= ? GROUP BY name`, hour)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bytes := make(map[string]int64)
+	for rows.Next() {
+		var name string
+		var n *int64
+		if err := rows.Scan(&name, &n); err != nil {
+			return nil, err
+		}
+		if n == nil {
+			// since removed
+			continue
+		}
+		typ, _, _ := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name)))
+		if typ == "" {
+			typ = "application/octet-stream"
+		}
+		bytes[typ] += *n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	report.BytesByType = []typeBytes{}
+	for typ, n := range bytes {
+		report.BytesByType = append(report.BytesByType, typeBytes{Type: typ, Bytes: n})
+	}
+	sort.Slice(report.BytesByType, func(i, j int) bool { return report.BytesByType[i].Bytes > report.BytesByType[j].Bytes })
+	return report, nil
+}
+
+// topNames sums the counts per name of the hits or misses table.
+func (s *SQLiteFS) topNames(table string, hour int64, limit int) ([]nameCount, error) {
+	rows, err := s.wdb.Query("SELECT name, sum(count) FROM "+quoteIdent(table)+" WHERE hour >= ? GROUP BY name ORDER BY 2 DESC LIMIT ?", hour, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []nameCount{}
+	for rows.Next() {
+		var c nameCount
+		if err := rows.Scan(&c.Name, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,239 @@
+package sqlitefs
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+	httpcaddyfile.RegisterGlobalOption("sqlitefs", parseGlobalOption)
+}
+
+// App holds defaults for every sqlite file system in the config, so sites
+// sharing the same tuning don't have to repeat it. Each of them applies to
+// file systems that leave the option unset.
+type App struct {
+	FlushInterval        caddy.Duration    `json:"flush_interval,omitempty"`
+	Expired              string            `json:"expired,omitempty"`
+	StaleGrace           caddy.Duration    `json:"stale_grace,omitempty"`
+	CaseInsensitive      bool              `json:"case_insensitive,omitempty"`
+	UnicodeNormalization string            `json:"unicode_normalization,omitempty"`
+	PercentDecode        bool              `json:"percent_decode,omitempty"`
+	ContentEncoding      string            `json:"content_encoding,omitempty"`
+	ExternalPrefixes     []string          `json:"external_prefixes,omitempty"`
+	MaxDepth             int               `json:"max_depth,omitempty"`
+	MaxNameLength        int               `json:"max_name_length,omitempty"`
+	MaxListEntries       int               `json:"max_list_entries,omitempty"`
+	StreamThreshold      int64             `json:"stream_threshold,omitempty"`
+	StreamChunkSize      int64             `json:"stream_chunk_size,omitempty"`
+	PermissionDenied     []string          `json:"permission_denied,omitempty"`
+	Collation            *Collation        `json:"collation,omitempty"`
+	ClientLimit          *ClientLimit      `json:"client_limit,omitempty"`
+	Driver               string            `json:"driver,omitempty"`
+	Pragmas              map[string]string `json:"pragmas,omitempty"`
+	MaxOpenConns         int               `json:"max_open_conns,omitempty"`
+	MaxIdleConns         int               `json:"max_idle_conns,omitempty"`
+	MemoryCache          *MemoryCache      `json:"memory_cache,omitempty"`
+	Timeout              caddy.Duration    `json:"timeout,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "sqlitefs",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+func (*App) Start() error { return nil }
+func (*App) Stop() error  { return nil }
+
+// applyDefaults fills the options s leaves unset from the sqlitefs app.
+func (s *SQLiteFS) applyDefaults(ctx caddy.Context) error {
+	if ctx.Context == nil {
+		// not loaded as part of a config
+		return nil
+	}
+	mod, err := ctx.App("sqlitefs")
+	if err != nil {
+		return err
+	}
+	a := mod.(*App)
+	if s.FlushInterval == 0 {
+		s.FlushInterval = a.FlushInterval
+	}
+	if s.Expired == "" {
+		s.Expired = a.Expired
+	}
+	if s.StaleGrace == 0 {
+		s.StaleGrace = a.StaleGrace
+	}
+	s.CaseInsensitive = s.CaseInsensitive || a.CaseInsensitive
+	if s.UnicodeNormalization == "" {
+		s.UnicodeNormalization = a.UnicodeNormalization
+	}
+	s.PercentDecode = s.PercentDecode || a.PercentDecode
+	if s.ContentEncoding == "" {
+		s.ContentEncoding = a.ContentEncoding
+	}
+	if s.ExternalPrefixes == nil {
+		s.ExternalPrefixes = a.ExternalPrefixes
+	}
+	if s.MaxDepth == 0 {
+		s.MaxDepth = a.MaxDepth
+	}
+	if s.MaxNameLength == 0 {
+		s.MaxNameLength = a.MaxNameLength
+	}
+	if s.MaxListEntries == 0 {
+		s.MaxListEntries = a.MaxListEntries
+	}
+	if s.StreamThreshold == 0 {
+		s.StreamThreshold = a.StreamThreshold
+	}
+	if s.StreamChunkSize == 0 {
+		s.StreamChunkSize = a.StreamChunkSize
+	}
+	if s.PermissionDenied == nil {
+		s.PermissionDenied = a.PermissionDenied
+	}
+	if s.Collation == nil {
+		s.Collation = a.Collation
+	}
+	if s.ClientLimit == nil {
+		s.ClientLimit = a.ClientLimit
+	}
+	if s.Driver == "" {
+		s.Driver = a.Driver
+	}
+	if s.Pragmas == nil {
+		s.Pragmas = a.Pragmas
+	}
+	if s.MaxOpenConns == 0 {
+		s.MaxOpenConns = a.MaxOpenConns
+	}
+	if s.MaxIdleConns == 0 {
+		s.MaxIdleConns = a.MaxIdleConns
+	}
+	if s.MemoryCache == nil {
+		s.MemoryCache = a.MemoryCache
+	}
+	if s.Timeout == 0 {
+		s.Timeout = a.Timeout
+	}
+	return nil
+}
+
+// parseGlobalOption sets up the sqlitefs app from the global option.
+// Syntax:
+//
+//	sqlitefs {
+//		flush_interval <duration>
+//		expired not_found|gone|stale
+//		stale_grace <duration>
+//		case_insensitive
+//		unicode_normalization nfc|nfd
+//		percent_decode
+//		content_encoding raw|base64
+//		external_prefixes <prefixes...>
+//		max_depth <n>
+//		max_name_length <n>
+//		max_list_entries <n>
+//		stream_threshold <size>
+//		stream_chunk_size <size>
+//		permission_denied <states...>
+//		collation <language> [ignore_case] [ignore_diacritics]
+//		client_limit <max_concurrent> [<rate> [<burst>]] {
+//			client <placeholder>
+//		}
+//		driver mattn|modernc
+//		pragma <name> <value>
+//		max_open_conns <n>
+//		max_idle_conns <n>
+//		memory_cache {
+//			max_bytes <size>
+//			max_entries <n>
+//			ttl <duration>
+//		}
+//		timeout <duration>
+//	}
+func parseGlobalOption(d *caddyfile.Dispenser, existing any) (any, error) {
+	a := new(App)
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+	return httpcaddyfile.App{Name: "sqlitefs", Value: caddyconfig.JSON(a, nil)}, nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (a *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			var err error
+			switch d.Val() {
+			case "flush_interval":
+				err = parseDurationArg(d, &a.FlushInterval)
+			case "expired":
+				err = parseStringArg(d, &a.Expired)
+			case "stale_grace":
+				err = parseDurationArg(d, &a.StaleGrace)
+			case "case_insensitive":
+				err = parseFlag(d, &a.CaseInsensitive)
+			case "unicode_normalization":
+				err = parseStringArg(d, &a.UnicodeNormalization)
+			case "percent_decode":
+				err = parseFlag(d, &a.PercentDecode)
+			case "content_encoding":
+				err = parseStringArg(d, &a.ContentEncoding)
+			case "external_prefixes":
+				err = parseListArgs(d, &a.ExternalPrefixes)
+			case "max_depth":
+				err = parseIntArg(d, &a.MaxDepth)
+			case "max_name_length":
+				err = parseIntArg(d, &a.MaxNameLength)
+			case "max_list_entries":
+				err = parseIntArg(d, &a.MaxListEntries)
+			case "stream_threshold":
+				err = parseSizeArg(d, &a.StreamThreshold)
+			case "stream_chunk_size":
+				err = parseSizeArg(d, &a.StreamChunkSize)
+			case "permission_denied":
+				err = parseListArgs(d, &a.PermissionDenied)
+			case "collation":
+				a.Collation, err = parseCollation(d)
+			case "client_limit":
+				a.ClientLimit, err = parseClientLimit(d)
+			case "driver":
+				err = parseStringArg(d, &a.Driver)
+			case "pragma":
+				err = parsePragma(d, &a.Pragmas)
+			case "max_open_conns":
+				err = parseIntArg(d, &a.MaxOpenConns)
+			case "max_idle_conns":
+				err = parseIntArg(d, &a.MaxIdleConns)
+			case "memory_cache":
+				a.MemoryCache, err = parseMemoryCache(d)
+			case "timeout":
+				err = parseDurationArg(d, &a.Timeout)
+			default:
+				return d.Errf("unrecognized parameter '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.App             = (*App)(nil)
+	_ caddyfile.Unmarshaler = (*App)(nil)
+)
@@ -0,0 +1,101 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const bandwidthSchema = `
+CREATE TABLE IF NOT EXISTS "bandwidth" (
+	"prefix" TEXT,
+	"hour" INTEGER, -- unix timestamp of the start of the hour
+	"bytes" INTEGER,
+	PRIMARY KEY ("prefix", "hour")
+) WITHOUT ROWID;
+`
+
+// startBandwidth begins summing bytes read from files into the bandwidth
+// table under the keys of accountingKeys.
+func (s *SQLiteFS) startBandwidth(db *sql.DB, logger *zap.Logger) error {
+	if _, err := db.Exec(bandwidthSchema); err != nil {
+		return fmt.Errorf("creating bandwidth table: %w", err)
+	}
+	s.bandwidth = newBatcher(time.Duration(s.FlushInterval),
+		func(old, v int64) int64 { return old + v },
+		func(pending map[string]int64) error {
+			return withTx(db, func(tx *sql.Tx) error {
+				hour := time.Now().Truncate(time.Hour).Unix()
+				for prefix, n := range pending {
+					_, err := tx.Exec(`INSERT INTO bandwidth (prefix, hour, bytes) VALUES (?, ?, ?)
+						ON CONFLICT(prefix, hour) DO UPDATE SET bytes=bytes+excluded.bytes`, prefix, hour, n)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+		func(err error) { logger.Error("recording bandwidth", zap.Error(err)) },
+	)
+	return nil
+}
+
+// accountingKeys returns the keys of the bandwidth table that reading name
+// for ctx is charged to: the longest accounting prefix of name, and the
+// tenant with AccountTenants.
+func (s *SQLiteFS) accountingKeys(ctx context.Context, name string) []string {
+	var keys []string
+	if prefix, ok := s.accountingPrefix(name); ok {
+		keys = append(keys, prefix)
+	}
+	if s.AccountTenants {
+		if tenant := s.tenant(ctx); tenant != "" {
+			keys = append(keys, tenantAccountingKey+tenant)
+		}
+	}
+	return keys
+}
+
+// tenantAccountingKey prefixes the tenants in the bandwidth table.
+const tenantAccountingKey = "tenant:"
+
+// accountingPrefix returns the longest configured prefix of name.
+func (s *SQLiteFS) accountingPrefix(name string) (string, bool) {
+	best, found := "", false
+	for _, p := range s.AccountPrefixes {
+		if strings.HasPrefix(name, p) && (!found || len(p) > len(best)) {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
+
+// bandwidthUsage is one row of the bandwidth report.
+type bandwidthUsage struct {
+	Prefix string `json:"prefix"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// bandwidthSince sums the bytes served per prefix since t.
+func (s *SQLiteFS) bandwidthSince(t time.Time) ([]bandwidthUsage, error) {
+	rows, err := s.wdb.Query("SELECT prefix, sum(bytes) FROM bandwidth WHERE hour >= ? GROUP BY prefix ORDER BY 2 DESC", t.Truncate(time.Hour).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []bandwidthUsage{}
+	for rows.Next() {
+		var u bandwidthUsage
+		if err := rows.Scan(&u.Prefix, &u.Bytes); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
@@ -0,0 +1,74 @@
+package sqlitefs
+
+import (
+	"sync"
+	"time"
+)
+
+// batcher coalesces updates keyed by name in memory and hands them to
+// flush in the background, so request paths never wait on a write.
+type batcher[V any] struct {
+	merge func(old, v V) V
+	flush func(map[string]V) error
+
+	mu      sync.Mutex
+	pending map[string]V
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBatcher[V any](interval time.Duration, merge func(old, v V) V, flush func(map[string]V) error, onError func(error)) *batcher[V] {
+	b := &batcher[V]{
+		merge:   merge,
+		flush:   flush,
+		pending: make(map[string]V),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-b.stop:
+				if err := b.drain(); err != nil {
+					onError(err)
+				}
+				return
+			}
+			if err := b.drain(); err != nil {
+				onError(err)
+			}
+		}
+	}()
+	return b
+}
+
+func (b *batcher[V]) add(name string, v V) {
+	b.mu.Lock()
+	if old, ok := b.pending[name]; ok {
+		v = b.merge(old, v)
+	}
+	b.pending[name] = v
+	b.mu.Unlock()
+}
+
+func (b *batcher[V]) drain() error {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[string]V)
+	b.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	return b.flush(pending)
+}
+
+// close flushes what is pending and stops the background goroutine.
+func (b *batcher[V]) close() {
+	close(b.stop)
+	<-b.done
+}
@@ -0,0 +1,409 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(CacheHandler{})
+	httpcaddyfile.RegisterHandlerDirective("sqlite_cache", parseCacheHandler)
+}
+
+// CacheHandler stores responses from the handlers after it in a sqlite
+// table and replays them until they expire, giving reverse-proxied backends
+// a cache that survives restarts.
+type CacheHandler struct {
+	DBPath string `json:"db_path,omitempty"`
+
+	// Table to cache responses in, created if missing. Default: responses.
+	Table string `json:"table,omitempty"`
+
+	// How long a response is served from the cache. Default: 1m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// Request methods to cache. Default: GET, HEAD.
+	Methods []string `json:"methods,omitempty"`
+
+	// Largest response body to cache, in bytes. Default: 10MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	db     *sql.DB
+	table  string
+	logger *zap.Logger
+	done   chan struct{}
+}
+
+// CaddyModule returns the Caddy module information.
+func (CacheHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.sqlite_cache",
+		New: func() caddy.Module { return new(CacheHandler) },
+	}
+}
+
+func (h *CacheHandler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger()
+	if h.Table == "" {
+		h.Table = "responses"
+	}
+	if h.TTL <= 0 {
+		h.TTL = caddy.Duration(time.Minute)
+	}
+	if len(h.Methods) == 0 {
+		h.Methods = []string{http.MethodGet, http.MethodHead}
+	}
+	if h.MaxSize <= 0 {
+		h.MaxSize = 10 << 20
+	}
+
+	db, err := openSQLite(h.DBPath)
+	if err != nil {
+		return err
+	}
+	h.table = quoteIdent(h.Table)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ` + h.table + ` (
+		"key" TEXT,         -- method and URL
+		"vary_key" TEXT,    -- request header values named by vary
+		"vary" TEXT,        -- comma separated header names from the Vary response header
+		"status" INTEGER,
+		"header" TEXT,      -- JSON encoded response header
+		"content" BLOB,
+		"expired_at" INTEGER,
+		PRIMARY KEY ("key", "vary_key")
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS ` + quoteIdent(h.Table+"_expired_at") + ` ON ` + h.table + ` ("expired_at")`)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("creating cache table: %w", err)
+	}
+	h.db = db
+	h.done = make(chan struct{})
+	go h.purge()
+	return nil
+}
+
+// purge deletes the expired responses every TTL, or every minute if that
+// is shorter, so the table doesn't keep every URL ever requested.
+func (h *CacheHandler) purge() {
+	interval := time.Duration(h.TTL)
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if _, err := h.db.Exec("DELETE FROM "+h.table+" WHERE expired_at <= ?", time.Now().Unix()); err != nil {
+				h.logger.Error("purging expired responses", zap.Error(err))
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *CacheHandler) Cleanup() error {
+	if h.done != nil {
+		close(h.done)
+	}
+	if h.db != nil {
+		return h.db.Close()
+	}
+	return nil
+}
+
+func (h *CacheHandler) Validate() error {
+	if h.DBPath == "" {
+		return errors.New("db_path is required")
+	}
+	return nil
+}
+
+func (h *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if !h.cacheable(r) {
+		return next.ServeHTTP(w, r)
+	}
+	key := r.Method + " " + r.Host + r.URL.RequestURI()
+
+	if ok, err := h.serveCached(w, r, key); ok || err != nil {
+		return err
+	}
+
+	rec := &cacheRecorder{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}, h: h, r: r}
+	if err := next.ServeHTTP(rec, r); err != nil {
+		return err
+	}
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.buffering {
+		return nil
+	}
+	h.store(r, key, rec.status, rec.Header(), rec.buf.Bytes())
+	w.Header().Set("X-Cache", "MISS")
+	w.WriteHeader(rec.status)
+	_, err := w.Write(rec.buf.Bytes())
+	return err
+}
+
+// cacheRecorder buffers a storable response to store it once it is
+// complete, and passes on the others as they are written, including those
+// that turn out to be larger than MaxSize.
+type cacheRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	h *CacheHandler
+	r *http.Request
+
+	status      int
+	wroteHeader bool
+	buffering   bool
+	buf         bytes.Buffer
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	if status >= 100 && status < 200 {
+		// informational, and not the response
+		rec.ResponseWriterWrapper.WriteHeader(status)
+		return
+	}
+	rec.status, rec.wroteHeader = status, true
+	rec.buffering = rec.h.storable(rec.r, status, rec.Header())
+	if !rec.buffering {
+		rec.ResponseWriterWrapper.WriteHeader(status)
+	}
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.buffering {
+		return rec.ResponseWriterWrapper.Write(p)
+	}
+	if int64(rec.buf.Len()+len(p)) <= rec.h.MaxSize {
+		return rec.buf.Write(p)
+	}
+	// too large to store after all
+	rec.buffering = false
+	rec.ResponseWriterWrapper.WriteHeader(rec.status)
+	if _, err := rec.ResponseWriterWrapper.Write(rec.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	rec.buf = bytes.Buffer{}
+	return rec.ResponseWriterWrapper.Write(p)
+}
+
+// ReadFrom goes through Write, which the wrapper's would bypass.
+func (rec *cacheRecorder) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{rec}, r)
+}
+
+// FlushError implements the flushing of http.ResponseController, which
+// waits for the end of buffered responses.
+func (rec *cacheRecorder) FlushError() error {
+	if rec.buffering {
+		return nil
+	}
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+		if rec.buffering {
+			return nil
+		}
+	}
+	return http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+func (h *CacheHandler) cacheable(r *http.Request) bool {
+	for _, m := range h.Methods {
+		if r.Method == m {
+			cc := r.Header.Get("Cache-Control")
+			return !strings.Contains(cc, "no-cache") && !strings.Contains(cc, "no-store")
+		}
+	}
+	return false
+}
+
+// storable reports whether the upstream response to r may be shared.
+func (h *CacheHandler) storable(r *http.Request, status int, header http.Header) bool {
+	if status != http.StatusOK && status != http.StatusNotFound && status != http.StatusMovedPermanently {
+		return false
+	}
+	if header.Get("Set-Cookie") != "" || header.Get("Vary") == "*" {
+		return false
+	}
+	cc := header.Get("Cache-Control")
+	if strings.Contains(cc, "no-store") || strings.Contains(cc, "private") || strings.Contains(cc, "no-cache") {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !strings.Contains(cc, "public") && !strings.Contains(cc, "s-maxage") {
+		// meant for that client alone, unless the response says otherwise
+		return false
+	}
+	if cl, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && cl > h.MaxSize {
+		return false
+	}
+	return true
+}
+
+// serveCached writes a cached response for key if a fresh one matches the
+// request's Vary headers.
+func (h *CacheHandler) serveCached(w http.ResponseWriter, r *http.Request, key string) (bool, error) {
+	rows, err := h.db.QueryContext(r.Context(), "SELECT vary_key, vary, status, header, content FROM "+h.table+" WHERE key=? AND expired_at > ?", key, time.Now().Unix())
+	if err != nil {
+		h.logger.Error("querying cache", zap.String("key", key), zap.Error(err))
+		return false, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var varyKey, vary, header string
+		var status int
+		var content []byte
+		if err := rows.Scan(&varyKey, &vary, &status, &header, &content); err != nil {
+			h.logger.Error("reading cached response", zap.String("key", key), zap.Error(err))
+			return false, nil
+		}
+		if varyKey != requestVaryKey(r, vary) {
+			continue
+		}
+		var hdr http.Header
+		if err := json.Unmarshal([]byte(header), &hdr); err != nil {
+			return false, nil
+		}
+		for k, v := range hdr {
+			w.Header()[k] = v
+		}
+		w.Header().Set("X-Cache", "HIT")
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			_, err = w.Write(content)
+		}
+		return true, err
+	}
+	return false, nil
+}
+
+func (h *CacheHandler) store(r *http.Request, key string, status int, header http.Header, content []byte) {
+	vary := strings.Join(header.Values("Vary"), ",")
+	hdr, err := json.Marshal(header)
+	if err != nil {
+		return
+	}
+	_, err = h.db.Exec(`INSERT INTO `+h.table+` (key, vary_key, vary, status, header, content, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(key, vary_key) DO UPDATE SET vary=excluded.vary, status=excluded.status, header=excluded.header, content=excluded.content, expired_at=excluded.expired_at`,
+		key, requestVaryKey(r, vary), vary, status, string(hdr), content, time.Now().Add(time.Duration(h.TTL)).Unix())
+	if err != nil {
+		h.logger.Error("storing cached response", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// requestVaryKey joins the request's values for the header names in vary.
+func requestVaryKey(r *http.Request, vary string) string {
+	var sb strings.Builder
+	for _, name := range strings.Split(vary, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		sb.WriteString(http.CanonicalHeaderKey(name))
+		sb.WriteByte('=')
+		sb.WriteString(strings.Join(r.Header.Values(name), ","))
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// parseCacheHandler sets up the handler from Caddyfile tokens. Syntax:
+//
+//	sqlite_cache [<matcher>] <db_path> {
+//		table    <name>
+//		ttl      <duration>
+//		methods  <method...>
+//		max_size <bytes>
+//	}
+func parseCacheHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	ch := new(CacheHandler)
+	err := ch.UnmarshalCaddyfile(h.Dispenser)
+	return ch, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (h *CacheHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			h.DBPath = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "db_path":
+				if !d.AllArgs(&h.DBPath) {
+					return d.ArgErr()
+				}
+			case "table":
+				if !d.AllArgs(&h.Table) {
+					return d.ArgErr()
+				}
+			case "ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing ttl: %v", err)
+				}
+				h.TTL = caddy.Duration(dur)
+			case "methods":
+				h.Methods = d.RemainingArgs()
+				if len(h.Methods) == 0 {
+					return d.ArgErr()
+				}
+			case "max_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.ParseInt(d.Val(), 10, 64)
+				if err != nil {
+					return d.Errf("parsing max_size: %v", err)
+				}
+				h.MaxSize = n
+			default:
+				return d.Errf("unrecognized parameter '%s'", d.Val())
+			}
+		}
+	}
+	if h.DBPath == "" {
+		return d.Err("missing db_path")
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddyhttp.MiddlewareHandler = (*CacheHandler)(nil)
+	_ caddy.Provisioner           = (*CacheHandler)(nil)
+	_ caddy.CleanerUpper          = (*CacheHandler)(nil)
+	_ caddy.Validator             = (*CacheHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*CacheHandler)(nil)
+)
@@ -0,0 +1,66 @@
+package sqlitefs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestCacheHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		body         string
+		cacheControl string
+		auth         bool
+		cached       bool
+	}{
+		{"small", "hello", "", false, true},
+		{"over max_size", strings.Repeat("x", 100), "", false, false},
+		{"at max_size", strings.Repeat("x", 64), "", false, true},
+		{"authorized", "hello", "", true, false},
+		{"authorized public", "hello", "public, max-age=60", true, true},
+		{"authorized s-maxage", "hello", "s-maxage=60", true, true},
+		{"private", "hello", "private", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &CacheHandler{DBPath: filepath.Join(t.TempDir(), "cache.db"), MaxSize: 64}
+			if err := h.Provision(caddy.Context{}); err != nil {
+				t.Fatal(err)
+			}
+			defer h.Cleanup()
+			calls := 0
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				calls++
+				if tc.cacheControl != "" {
+					w.Header().Set("Cache-Control", tc.cacheControl)
+				}
+				// in pieces and without a Content-Length
+				for i := 0; i < len(tc.body); i += 10 {
+					w.Write([]byte(tc.body[i:min(i+10, len(tc.body))]))
+				}
+				return nil
+			})
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest(http.MethodGet, "http://example.com/a", nil)
+				if tc.auth {
+					r.Header.Set("Authorization", "Bearer secret")
+				}
+				w := httptest.NewRecorder()
+				if err := h.ServeHTTP(w, r, next); err != nil {
+					t.Fatal(err)
+				}
+				if w.Body.String() != tc.body {
+					t.Fatalf("request %d: got body of %d bytes, want %d", i, w.Body.Len(), len(tc.body))
+				}
+			}
+			if want := map[bool]int{true: 1, false: 2}[tc.cached]; calls != want {
+				t.Errorf("next handler called %d times, want %d", calls, want)
+			}
+		})
+	}
+}
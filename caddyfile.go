@@ -1,15 +1,621 @@
 package sqlitefs
 
-import "github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
 //
-//	sqlite <db_path>
+//	sqlite [<db_path>] {
+//		db_path <path>
+//		table <table>
+//		name_column <column>
+//		content_column <column>
+//		modified_column <column>
+//		mode_column <column>
+//		expires_column <column>
+//		query <select>
+//		create_schema
+//		name <name>
+//		log_level <level>
+//		track_hits
+//		track_access
+//		account_prefixes <prefixes...>
+//		account_tenants
+//		flush_interval <duration>
+//		driver mattn|modernc
+//		exclusive_locking
+//		read_only
+//		immutable
+//		key <key>
+//		key_file <path>
+//		pragma <name> <value>
+//		max_open_conns <n>
+//		max_idle_conns <n>
+//		timeout <duration>
+//		keepalive <interval>
+//		watch <interval>
+//
+//		tenant_column <column>
+//		tenant <placeholder>
+//		tenant_quota <max_bytes> [<max_files>]
+//		require_if_match
+//		storage_quota <max_bytes> [<max_files>]
+//		prefix_quota <prefix> <max_bytes> [<max_files>]
+//		quota_exceeded reject|evict_oldest
+//		upload_policy {
+//			max_size <size>
+//			allowed_types <patterns...>
+//			allowed_extensions <extensions...>
+//			name_pattern <regexp>
+//			scan_url <url>
+//			scan_timeout <duration>
+//		}
+//
+//		require_published
+//		preview <placeholder> <token>
+//		version <version>
+//		generation <version>
+//		dataset <label>
+//		variant <placeholder>
+//
+//		expired not_found|gone|stale
+//		stale_grace <duration>
+//		purge_expired <interval>
+//		permission_denied <states...>
+//
+//		case_insensitive
+//		collation <language> [ignore_case] [ignore_diacritics]
+//		unicode_normalization nfc|nfd
+//		percent_decode
+//
+//		content_encoding raw|base64
+//		compression gzip|zstd
+//		external_prefixes <prefixes...>
+//		virtual_file <name> <content>
+//		root <dir>
+//		mounts {
+//			<prefix> <db_path>
+//		}
+//		fallback <fs_module> ...
+//		fallback_root <dir>
+//		max_databases <n>
+//		stream_threshold <size>
+//		stream_chunk_size <size>
+//		chunk_size <size>
+//
+//		max_depth <n>
+//		max_name_length <n>
+//		max_list_entries <n>
+//		client_limit <max_concurrent> [<rate> [<burst>]] {
+//			client <placeholder>
+//		}
+//
+//		memory_cache {
+//			max_bytes <size>
+//			max_entries <n>
+//			ttl <duration>
+//		}
+//
+//		warmup {
+//			query <sql>
+//			bytes <size>
+//			hot_files <n>
+//		}
+//	}
 func (s *SQLiteFS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
-		if !d.AllArgs(&s.DBPath) {
+		if d.NextArg() {
+			s.DBPath = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			var err error
+			switch d.Val() {
+			case "db_path":
+				err = parseStringArg(d, &s.DBPath)
+			case "table":
+				err = parseStringArg(d, &s.Table)
+			case "name_column":
+				err = parseStringArg(d, &s.NameColumn)
+			case "content_column":
+				err = parseStringArg(d, &s.ContentColumn)
+			case "modified_column":
+				err = parseStringArg(d, &s.ModifiedColumn)
+			case "mode_column":
+				err = parseStringArg(d, &s.ModeColumn)
+			case "expires_column":
+				err = parseStringArg(d, &s.ExpiresColumn)
+			case "query":
+				err = parseStringArg(d, &s.Query)
+			case "create_schema":
+				err = parseFlag(d, &s.CreateSchema)
+			case "name":
+				err = parseStringArg(d, &s.Name)
+			case "log_level":
+				err = parseStringArg(d, &s.LogLevel)
+			case "track_hits":
+				err = parseFlag(d, &s.TrackHits)
+			case "track_access":
+				err = parseFlag(d, &s.TrackAccess)
+			case "account_prefixes":
+				err = parseListArgs(d, &s.AccountPrefixes)
+			case "account_tenants":
+				err = parseFlag(d, &s.AccountTenants)
+			case "flush_interval":
+				err = parseDurationArg(d, &s.FlushInterval)
+			case "driver":
+				err = parseStringArg(d, &s.Driver)
+			case "exclusive_locking":
+				err = parseFlag(d, &s.ExclusiveLocking)
+			case "read_only":
+				err = parseFlag(d, &s.ReadOnly)
+			case "immutable":
+				err = parseFlag(d, &s.Immutable)
+			case "key":
+				err = parseStringArg(d, &s.Key)
+			case "key_file":
+				err = parseStringArg(d, &s.KeyFile)
+			case "pragma":
+				err = parsePragma(d, &s.Pragmas)
+			case "max_open_conns":
+				err = parseIntArg(d, &s.MaxOpenConns)
+			case "max_idle_conns":
+				err = parseIntArg(d, &s.MaxIdleConns)
+			case "timeout":
+				err = parseDurationArg(d, &s.Timeout)
+			case "keepalive":
+				err = parseDurationArg(d, &s.Keepalive)
+			case "watch":
+				err = parseDurationArg(d, &s.Watch)
+			case "tenant_column":
+				err = parseStringArg(d, &s.TenantColumn)
+			case "tenant":
+				err = parseStringArg(d, &s.Tenant)
+			case "tenant_quota":
+				s.TenantQuota, err = parseQuota(d)
+			case "require_if_match":
+				err = parseFlag(d, &s.RequireIfMatch)
+			case "storage_quota":
+				s.StorageQuota, err = parseQuota(d)
+			case "prefix_quota":
+				err = parsePrefixQuota(d, &s.PrefixQuotas)
+			case "quota_exceeded":
+				err = parseStringArg(d, &s.QuotaExceeded)
+			case "upload_policy":
+				s.UploadPolicy, err = parseUploadPolicy(d)
+			case "require_published":
+				err = parseFlag(d, &s.RequirePublished)
+			case "preview":
+				if !d.AllArgs(&s.Preview, &s.PreviewToken) {
+					return d.ArgErr()
+				}
+			case "version":
+				err = parseStringArg(d, &s.Version)
+			case "generation":
+				err = parseStringArg(d, &s.Generation)
+			case "dataset":
+				err = parseStringArg(d, &s.Dataset)
+			case "variant":
+				err = parseStringArg(d, &s.Variant)
+			case "expired":
+				err = parseStringArg(d, &s.Expired)
+			case "stale_grace":
+				err = parseDurationArg(d, &s.StaleGrace)
+			case "purge_expired":
+				err = parseDurationArg(d, &s.PurgeExpired)
+			case "permission_denied":
+				err = parseListArgs(d, &s.PermissionDenied)
+			case "case_insensitive":
+				err = parseFlag(d, &s.CaseInsensitive)
+			case "collation":
+				s.Collation, err = parseCollation(d)
+			case "unicode_normalization":
+				err = parseStringArg(d, &s.UnicodeNormalization)
+			case "percent_decode":
+				err = parseFlag(d, &s.PercentDecode)
+			case "content_encoding":
+				err = parseStringArg(d, &s.ContentEncoding)
+			case "compression":
+				err = parseStringArg(d, &s.Compression)
+			case "external_prefixes":
+				err = parseListArgs(d, &s.ExternalPrefixes)
+			case "virtual_file":
+				var name, content string
+				if !d.AllArgs(&name, &content) {
+					return d.ArgErr()
+				}
+				if s.VirtualFiles == nil {
+					s.VirtualFiles = make(map[string]string)
+				}
+				s.VirtualFiles[name] = content
+			case "root":
+				err = parseStringArg(d, &s.Root)
+			case "mounts":
+				err = parseMounts(d, &s.Mounts)
+			case "fallback":
+				err = parseFallback(d, &s.FallbackRaw)
+			case "fallback_root":
+				err = parseStringArg(d, &s.FallbackRoot)
+			case "max_databases":
+				err = parseIntArg(d, &s.MaxDatabases)
+			case "stream_threshold":
+				err = parseSizeArg(d, &s.StreamThreshold)
+			case "stream_chunk_size":
+				err = parseSizeArg(d, &s.StreamChunkSize)
+			case "chunk_size":
+				err = parseSizeArg(d, &s.ChunkSize)
+			case "max_depth":
+				err = parseIntArg(d, &s.MaxDepth)
+			case "max_name_length":
+				err = parseIntArg(d, &s.MaxNameLength)
+			case "max_list_entries":
+				err = parseIntArg(d, &s.MaxListEntries)
+			case "client_limit":
+				s.ClientLimit, err = parseClientLimit(d)
+			case "memory_cache":
+				s.MemoryCache, err = parseMemoryCache(d)
+			case "warmup":
+				s.Warmup, err = parseWarmup(d)
+			default:
+				return d.Errf("unrecognized parameter '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.DBPath == "" {
+		return d.Err("missing db_path")
+	}
+	s.DBPath = adaptDBPath(d, s.DBPath)
+	return nil
+}
+
+// adaptDBPath expands {env.*} placeholders in a database path from the
+// Caddyfile and warns, without failing, when it doesn't lead to a readable
+// sqlite database, since the file may well be created before the config
+// is loaded.
+func adaptDBPath(d *caddyfile.Dispenser, dbPath string) string {
+	dbPath = caddy.NewReplacer().ReplaceKnown(dbPath, "")
+	if dbPath == ":memory:" || strings.HasPrefix(dbPath, "file:") || perRequestPath(dbPath) {
+		return dbPath
+	}
+	warn := func(msg string, err error) {
+		caddy.Log().Warn(msg,
+			zap.String("db_path", dbPath),
+			zap.String("file", d.File()),
+			zap.Int("line", d.Line()),
+			zap.Error(err))
+	}
+	f, err := os.Open(dbPath)
+	if err != nil {
+		warn("sqlite database is missing or unreadable", err)
+		return dbPath
+	}
+	defer f.Close()
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(f, header); err != nil || string(header) != "SQLite format 3\x00" {
+		warn("file does not look like a sqlite database", err)
+	}
+	return dbPath
+}
+
+func parseFlag(d *caddyfile.Dispenser, v *bool) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	*v = true
+	return nil
+}
+
+func parseStringArg(d *caddyfile.Dispenser, v *string) error {
+	if !d.AllArgs(v) {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parseListArgs(d *caddyfile.Dispenser, v *[]string) error {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return d.ArgErr()
+	}
+	*v = append(*v, args...)
+	return nil
+}
+
+func parseDurationArg(d *caddyfile.Dispenser, v *caddy.Duration) error {
+	name := d.Val()
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return d.Errf("parsing %s: %v", name, err)
+	}
+	*v = caddy.Duration(dur)
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parseIntArg(d *caddyfile.Dispenser, v *int) error {
+	name := d.Val()
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	n, err := strconv.Atoi(d.Val())
+	if err != nil {
+		return d.Errf("parsing %s: %v", name, err)
+	}
+	*v = n
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// parseSizeArg parses a size such as 512KiB or 1MB.
+func parseSizeArg(d *caddyfile.Dispenser, v *int64) error {
+	name := d.Val()
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	n, err := humanize.ParseBytes(d.Val())
+	if err != nil {
+		return d.Errf("parsing %s: %v", name, err)
+	}
+	*v = int64(n)
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parseQuota(d *caddyfile.Dispenser) (*Quota, error) {
+	directive := d.Val()
+	return parseQuotaArgs(d, directive, d.RemainingArgs())
+}
+
+// parsePrefixQuota parses <prefix> <max_bytes> [<max_files>] into quotas.
+func parsePrefixQuota(d *caddyfile.Dispenser, quotas *map[string]*Quota) error {
+	args := d.RemainingArgs()
+	if len(args) < 2 {
+		return d.ArgErr()
+	}
+	q, err := parseQuotaArgs(d, "prefix_quota", args[1:])
+	if err != nil {
+		return err
+	}
+	if *quotas == nil {
+		*quotas = make(map[string]*Quota)
+	}
+	(*quotas)[args[0]] = q
+	return nil
+}
+
+func parseQuotaArgs(d *caddyfile.Dispenser, directive string, args []string) (*Quota, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, d.ArgErr()
+	}
+	q := new(Quota)
+	size, err := humanize.ParseBytes(args[0])
+	if err != nil {
+		return nil, d.Errf("parsing %s max_bytes: %v", directive, err)
+	}
+	q.MaxBytes = int64(size)
+	if len(args) > 1 {
+		if q.MaxFiles, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return nil, d.Errf("parsing %s max_files: %v", directive, err)
+		}
+	}
+	return q, nil
+}
+
+func parseWarmup(d *caddyfile.Dispenser) (*Warmup, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	w := new(Warmup)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "query":
+			err = parseStringArg(d, &w.Query)
+		case "bytes":
+			var size string
+			if !d.AllArgs(&size) {
+				return nil, d.ArgErr()
+			}
+			n, perr := humanize.ParseBytes(size)
+			if perr != nil {
+				return nil, d.Errf("parsing warmup bytes: %v", perr)
+			}
+			w.Bytes = int64(n)
+		case "hot_files":
+			err = parseIntArg(d, &w.HotFiles)
+		default:
+			return nil, d.Errf("unrecognized warmup parameter '%s'", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func parseMounts(d *caddyfile.Dispenser, mounts *map[string]string) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		prefix := d.Val()
+		var dbPath string
+		if !d.AllArgs(&dbPath) {
 			return d.ArgErr()
 		}
+		if *mounts == nil {
+			*mounts = make(map[string]string)
+		}
+		(*mounts)[prefix] = adaptDBPath(d, dbPath)
+	}
+	return nil
+}
+
+// parseFallback parses <fs_module> and the tokens of that module into raw.
+func parseFallback(d *caddyfile.Dispenser, raw *json.RawMessage) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	name := d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, "caddy.fs."+name)
+	if err != nil {
+		return err
+	}
+	*raw = caddyconfig.JSONModuleObject(unm, "backend", name, nil)
+	return nil
+}
+
+// parsePragma parses <name> <value> into pragmas.
+func parsePragma(d *caddyfile.Dispenser, pragmas *map[string]string) error {
+	var name, value string
+	if !d.AllArgs(&name, &value) {
+		return d.ArgErr()
+	}
+	if *pragmas == nil {
+		*pragmas = make(map[string]string)
 	}
+	(*pragmas)[name] = value
 	return nil
 }
+
+func parseMemoryCache(d *caddyfile.Dispenser) (*MemoryCache, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	c := new(MemoryCache)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "max_bytes":
+			err = parseSizeArg(d, &c.MaxBytes)
+		case "max_entries":
+			err = parseIntArg(d, &c.MaxEntries)
+		case "ttl":
+			err = parseDurationArg(d, &c.TTL)
+		default:
+			return nil, d.Errf("unrecognized memory_cache parameter '%s'", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func parseUploadPolicy(d *caddyfile.Dispenser) (*UploadPolicy, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	p := new(UploadPolicy)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var err error
+		switch d.Val() {
+		case "max_size":
+			var size string
+			if !d.AllArgs(&size) {
+				return nil, d.ArgErr()
+			}
+			n, perr := humanize.ParseBytes(size)
+			if perr != nil {
+				return nil, d.Errf("parsing upload_policy max_size: %v", perr)
+			}
+			p.MaxSize = int64(n)
+		case "allowed_types":
+			err = parseListArgs(d, &p.AllowedTypes)
+		case "allowed_extensions":
+			err = parseListArgs(d, &p.AllowedExtensions)
+		case "name_pattern":
+			var pattern string
+			err = parseStringArg(d, &pattern)
+			p.NamePatterns = append(p.NamePatterns, pattern)
+		case "scan_url":
+			err = parseStringArg(d, &p.ScanURL)
+		case "scan_timeout":
+			err = parseDurationArg(d, &p.ScanTimeout)
+		default:
+			return nil, d.Errf("unrecognized upload_policy parameter '%s'", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func parseCollation(d *caddyfile.Dispenser) (*Collation, error) {
+	c := new(Collation)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	c.Language = d.Val()
+	for d.NextArg() {
+		switch d.Val() {
+		case "ignore_case":
+			c.IgnoreCase = true
+		case "ignore_diacritics":
+			c.IgnoreDiacritics = true
+		default:
+			return nil, d.Errf("unrecognized collation option '%s'", d.Val())
+		}
+	}
+	return c, nil
+}
+
+func parseClientLimit(d *caddyfile.Dispenser) (*ClientLimit, error) {
+	l := new(ClientLimit)
+	args := d.RemainingArgs()
+	if len(args) < 1 || len(args) > 3 {
+		return nil, d.ArgErr()
+	}
+	var err error
+	if l.MaxConcurrent, err = strconv.Atoi(args[0]); err != nil {
+		return nil, d.Errf("parsing client_limit max_concurrent: %v", err)
+	}
+	if len(args) > 1 {
+		if l.Rate, err = strconv.ParseFloat(args[1], 64); err != nil {
+			return nil, d.Errf("parsing client_limit rate: %v", err)
+		}
+	}
+	if len(args) > 2 {
+		if l.Burst, err = strconv.Atoi(args[2]); err != nil {
+			return nil, d.Errf("parsing client_limit burst: %v", err)
+		}
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "client":
+			err = parseStringArg(d, &l.Client)
+		default:
+			return nil, d.Errf("unrecognized client_limit parameter '%s'", d.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
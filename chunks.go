@@ -0,0 +1,176 @@
+package sqlitefs
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+// Large files can keep their content in the file_chunks table, in ordered
+// pieces, instead of the content column: the chunks column of their row is
+// the id of the pieces. They are read one piece at a time, so serving them
+// takes the memory of one piece however large they are, and writes of
+// content larger than ChunkSize store it that way.
+
+// sizeColumn is the SQL expression of the size of the content of a row.
+func (s SQLiteFS) sizeColumn() string {
+	if !s.columns["chunks"] {
+		return "octet_length(content)"
+	}
+	return "coalesce(octet_length(content), (SELECT sum(length(data)) FROM file_chunks WHERE id=chunks))"
+}
+
+// chunkReader reads the content kept in the pieces of id, loading their
+// offsets on the first read.
+type chunkReader struct {
+	ctx     context.Context
+	timeout time.Duration // of each query
+	db      *sql.DB
+	metrics *instanceMetrics
+	id      string
+	size    int64
+	off     int64
+
+	seqs    []int64 // of the pieces, in order
+	offsets []int64 // of each piece in the content
+	piece   int     // index of the piece in buf, -1 for none
+	buf     []byte
+}
+
+// openChunks returns a reader of the size bytes of content in the pieces
+// of id.
+func (s SQLiteFS) openChunks(ctx context.Context, id string, size int64) *chunkReader {
+	return &chunkReader{
+		ctx:     ctx,
+		timeout: time.Duration(s.Timeout),
+		db:      s.db,
+		metrics: s.metrics,
+		id:      id,
+		size:    size,
+		piece:   -1,
+	}
+}
+
+func (r *chunkReader) queryContext() (context.Context, context.CancelFunc) {
+	if r.timeout <= 0 {
+		return r.ctx, func() {}
+	}
+	return context.WithTimeout(r.ctx, r.timeout)
+}
+
+// loadOffsets reads where each piece starts, without their data.
+func (r *chunkReader) loadOffsets() error {
+	ctx, cancel := r.queryContext()
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, "SELECT seq, length(data) FROM file_chunks WHERE id=? ORDER BY seq", r.id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var off int64
+	seqs, offsets := []int64{}, []int64{}
+	for rows.Next() {
+		var seq, n int64
+		if err := rows.Scan(&seq, &n); err != nil {
+			return err
+		}
+		seqs, offsets = append(seqs, seq), append(offsets, off)
+		off += n
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(seqs) == 0 {
+		// removed since it was opened
+		return fs.ErrNotExist
+	}
+	r.seqs, r.offsets = seqs, offsets
+	return nil
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.offsets == nil {
+		if err := r.loadOffsets(); err != nil {
+			return 0, err
+		}
+	}
+	// the last piece starting at or before the offset
+	i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > r.off }) - 1
+	if i != r.piece {
+		if err := r.fill(i); err != nil {
+			return 0, err
+		}
+	}
+	start := r.off - r.offsets[i]
+	if start >= int64(len(r.buf)) {
+		// shrunk since it was opened
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.buf[start:])
+	r.off += int64(n)
+	return n, nil
+}
+
+// fill reads the piece at index i.
+func (r *chunkReader) fill(i int) error {
+	ctx, cancel := r.queryContext()
+	defer cancel()
+	var data []byte
+	start := time.Now()
+	err := r.db.QueryRowContext(ctx, "SELECT data FROM file_chunks WHERE id=? AND seq=?", r.id, r.seqs[i]).Scan(&data)
+	r.metrics.queried("chunk", start)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fs.ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+	r.metrics.read(len(data))
+	r.buf, r.piece = data, i
+	return nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("chunkReader.Seek: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// writeChunks stores content in pieces of ChunkSize and returns their id.
+func (s SQLiteFS) writeChunks(ctx context.Context, tx *sql.Tx, content []byte) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO file_chunks (id, seq, data) VALUES (?, ?, ?)")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	for seq := int64(0); len(content) > 0; seq++ {
+		n := min(int64(len(content)), s.ChunkSize)
+		if _, err := stmt.ExecContext(ctx, id, seq, content[:n]); err != nil {
+			return "", err
+		}
+		content = content[n:]
+	}
+	return id, nil
+}
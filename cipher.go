@@ -0,0 +1,110 @@
+package sqlitefs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Databases encrypted with SQLCipher are opened with the key of Key or
+// KeyFile, given to each connection before anything reads the file. Neither
+// bundled sqlite has SQLCipher: it takes mattn built with the libsqlite3
+// tag and linked against libsqlcipher.
+
+var (
+	// ErrNoCipher is returned for keys of databases opened by a sqlite
+	// without SQLCipher, which would ignore them.
+	ErrNoCipher = errors.New("sqlite is built without SQLCipher")
+
+	// ErrWrongKey is returned when a database doesn't open with the key.
+	ErrWrongKey = errors.New("wrong key, or the database isn't encrypted")
+)
+
+// keySalt keeps the setup keys of keyed connections, which show up in
+// driver names, from telling anything about the key.
+var keySalt = func() []byte {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b
+}()
+
+// loadKey sets the key of s from Key, with the placeholders known at
+// provisioning such as {env.*} replaced, or from the file KeyFile, as
+// secrets are mounted into containers.
+func (s *SQLiteFS) loadKey() error {
+	switch {
+	case s.Key != "" && s.KeyFile != "":
+		return errors.New("key and key_file are mutually exclusive")
+	case s.Key != "":
+		s.key = caddy.NewReplacer().ReplaceKnown(s.Key, "")
+	case s.KeyFile != "":
+		b, err := os.ReadFile(s.KeyFile)
+		if err != nil {
+			return fmt.Errorf("reading key: %w", err)
+		}
+		s.key = strings.TrimRight(string(b), "\r\n")
+	default:
+		return nil
+	}
+	if s.key == "" {
+		return errors.New("the key is empty")
+	}
+	return nil
+}
+
+// keyHook returns the setup key and the connect hook giving key to
+// connections, which then set WAL mode if wal is set: earlier, reading the
+// journal mode would fail on the encrypted file.
+func keyHook(key string, wal bool) (string, func(sqliteConn) error) {
+	sum := sha256.Sum256(append(append([]byte(nil), keySalt...), key...))
+	setupKey := "key_" + hex.EncodeToString(sum[:8])
+	if !wal {
+		setupKey += "_ro"
+	}
+	return setupKey, func(conn sqliteConn) error {
+		ctx := context.Background()
+		rows, err := conn.QueryContext(ctx, "PRAGMA cipher_version", nil)
+		if err != nil {
+			return err
+		}
+		err = rows.Next(make([]driver.Value, len(rows.Columns())))
+		rows.Close()
+		if errors.Is(err, io.EOF) {
+			return ErrNoCipher
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, "PRAGMA key = '"+strings.ReplaceAll(key, "'", "''")+"'", nil); err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, "SELECT count(*) FROM sqlite_master", nil); err != nil {
+			return fmt.Errorf("%w: %w", ErrWrongKey, err)
+		}
+		if wal {
+			if _, err := conn.ExecContext(ctx, "PRAGMA journal_mode = WAL", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// writerSetup returns the setup of the read-write handles of s, nil if
+// they need none.
+func (s SQLiteFS) writerSetup() *connSetup {
+	if s.key == "" {
+		return nil
+	}
+	key, hook := keyHook(s.key, true)
+	return &connSetup{key: key, hooks: []func(sqliteConn) error{hook}, keyed: true}
+}
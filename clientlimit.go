@@ -0,0 +1,117 @@
+package sqlitefs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTooManyRequests is returned by expensive operations when the client
+// running them is over its ClientLimit.
+var ErrTooManyRequests = errors.New("too many requests")
+
+// ClientLimit bounds how much database time each client may take with the
+// expensive operations: directory listings, globs and searches. Plain file
+// lookups are never limited.
+type ClientLimit struct {
+	// Who the client is, a placeholder. Operations without a client, such
+	// as those outside of a request, are not limited.
+	// Default: {http.request.remote.host}.
+	Client string `json:"client,omitempty"`
+
+	// How many operations one client may run at once. 0 is unlimited.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// How many operations one client may start per second on average, in
+	// bursts of up to Burst. 0 is unlimited.
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// clientLimiter tracks the clients of a ClientLimit.
+type clientLimiter struct {
+	limit ClientLimit
+
+	mu      sync.Mutex
+	clients map[string]*clientState
+}
+
+type clientState struct {
+	running int
+	tokens  float64
+	updated time.Time
+}
+
+func newClientLimiter(limit ClientLimit) *clientLimiter {
+	if limit.Client == "" {
+		limit.Client = "{http.request.remote.host}"
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &clientLimiter{limit: limit, clients: make(map[string]*clientState)}
+}
+
+// acquire starts an operation of client, returning the function ending it,
+// or false if the client is over its limit.
+func (l *clientLimiter) acquire(client string) (func(), bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= 10000 {
+			l.forgetIdle(now)
+		}
+		c = &clientState{tokens: float64(l.limit.Burst), updated: now}
+		l.clients[client] = c
+	}
+	if l.limit.MaxConcurrent > 0 && c.running >= l.limit.MaxConcurrent {
+		return nil, false
+	}
+	if l.limit.Rate > 0 {
+		c.tokens = min(float64(l.limit.Burst), c.tokens+now.Sub(c.updated).Seconds()*l.limit.Rate)
+		c.updated = now
+		if c.tokens < 1 {
+			return nil, false
+		}
+		c.tokens--
+	}
+	c.running++
+	return func() {
+		l.mu.Lock()
+		c.running--
+		l.mu.Unlock()
+	}, true
+}
+
+// forgetIdle drops clients that run nothing and whose bucket has refilled,
+// as they are indistinguishable from new ones.
+func (l *clientLimiter) forgetIdle(now time.Time) {
+	for client, c := range l.clients {
+		full := l.limit.Rate <= 0 || c.tokens+now.Sub(c.updated).Seconds()*l.limit.Rate >= float64(l.limit.Burst)
+		if c.running == 0 && full {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// startExpensive starts an expensive operation for the client of ctx,
+// failing with ErrTooManyRequests if it is over ClientLimit. The returned
+// function must be called when the operation is done.
+func (s SQLiteFS) startExpensive(ctx context.Context) (func(), error) {
+	if s.limiter == nil {
+		return func() {}, nil
+	}
+	client := replacer(ctx).ReplaceAll(s.limiter.limit.Client, "")
+	if client == "" {
+		return func() {}, nil
+	}
+	done, ok := s.limiter.acquire(client)
+	if !ok {
+		return nil, ErrTooManyRequests
+	}
+	return done, nil
+}
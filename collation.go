@@ -0,0 +1,63 @@
+package sqlitefs
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// Collation is a Unicode collation for ordering listings and matching
+// names, for sites whose names sqlite's byte-wise BINARY and ASCII-only
+// NOCASE collations handle poorly.
+type Collation struct {
+	// The BCP 47 language whose rules apply, such as "de" or "ja".
+	// Default: "und", the language-neutral root collation.
+	Language string `json:"language,omitempty"`
+
+	// Let lookups that miss find a name differing only in case or
+	// diacritics, so sqlite_file_server can redirect to it.
+	IgnoreCase       bool `json:"ignore_case,omitempty"`
+	IgnoreDiacritics bool `json:"ignore_diacritics,omitempty"`
+}
+
+// options returns the language and options of the collation.
+func (c Collation) options() (language.Tag, []collate.Option, error) {
+	lang := c.Language
+	if lang == "" {
+		lang = "und"
+	}
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return tag, nil, fmt.Errorf("collation language %q: %w", lang, err)
+	}
+	var opts []collate.Option
+	if c.IgnoreCase {
+		opts = append(opts, collate.IgnoreCase)
+	}
+	if c.IgnoreDiacritics {
+		opts = append(opts, collate.IgnoreDiacritics)
+	}
+	return tag, opts, nil
+}
+
+// collator returns a collator for ordering names outside sqlite the way
+// the collation orders them inside it.
+func (c Collation) collator() (*collate.Collator, error) {
+	tag, opts, err := c.options()
+	if err != nil {
+		return nil, err
+	}
+	return collate.New(tag, opts...), nil
+}
+
+// sqlName returns the name the collation is registered under in sqlite,
+// one for each setting.
+func (c Collation) sqlName() string {
+	lang := strings.ToLower(strings.ReplaceAll(c.Language, "-", "_"))
+	if lang == "" {
+		lang = "und"
+	}
+	return fmt.Sprintf("sqlitefs_%s_%t_%t", lang, c.IgnoreCase, c.IgnoreDiacritics)
+}
@@ -0,0 +1,82 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content can be stored compressed, with the compression column naming
+// how. It is decompressed when it is served, or sent as it is by
+// sqlite_file_server to clients accepting that Content-Encoding, which is
+// what the names of compressions are.
+
+var (
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) { return zstd.NewReader(nil) })
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	})
+)
+
+func validCompression(compression string) bool {
+	return compression == "gzip" || compression == "zstd"
+}
+
+// decompress returns content stored with compression decompressed.
+func decompress(compression string, content []byte) ([]byte, error) {
+	switch compression {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing gzip content: %w", err)
+		}
+		out, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing gzip content: %w", err)
+		}
+		return out, nil
+	case "zstd":
+		d, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		out, err := d.DecodeAll(content, nil)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing zstd content: %w", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+// compress returns content compressed with compression.
+func compress(compression string, content []byte) ([]byte, error) {
+	switch compression {
+	case "gzip":
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(content); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		e, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return e.EncodeAll(content, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
@@ -0,0 +1,112 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// openSQLite opens a read-write handle for modules that write to the
+// database, waiting on locks held by other writers instead of failing.
+func openSQLite(dbPath string) (*sql.DB, error) {
+	return defaultDriver.openWriter(dbPath, nil)
+}
+
+// openWriter is openSQLite with driver d, and with setup if it isn't nil.
+func (d sqliteDriver) openWriter(dbPath string, setup *connSetup) (*sql.DB, error) {
+	db, err := d.open(dbPath, dsnOptions{}, setup)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", dbPath, err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %w", dbPath, err)
+	}
+	return db, nil
+}
+
+// quoteIdent quotes a table or column name from config for use in SQL.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// withTx runs fn in a transaction, committing if it returns nil.
+func withTx(db *sql.DB, fn func(*sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// withWriteTx is withTx for transactions that read what they then change.
+// It takes the write lock up front, so no other writer can change the rows
+// in between and sqlite doesn't have to fail the upgrade from reading.
+func withWriteTx(ctx context.Context, db *sql.DB, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// writes nothing, but starts the write transaction
+	if _, err := tx.ExecContext(ctx, "UPDATE files SET name=name WHERE 0"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumn adds column to table unless it is already there.
+func addColumn(db *sql.DB, table, column, typ string) error {
+	ok, err := hasColumn(db, table, column)
+	if err != nil || ok {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + quoteIdent(table) + " ADD COLUMN " + quoteIdent(column) + " " + typ)
+	if err != nil {
+		return fmt.Errorf("adding %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM pragma_table_info(?) WHERE name=?", table, column).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("inspecting %s: %w", table, err)
+	}
+	return n > 0, nil
+}
+
+// tableColumns returns the names of the columns of table.
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name=?", table).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,236 @@
+package sqlitefs
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// A db_path with placeholders that are only known for a request, such as
+// {http.vars.tenant}.db, names a database for each request. They are opened
+// on first use, each through a file system configured like this one, and
+// the least recently used ones closed beyond MaxDatabases.
+//
+// With Watch, a static db_path is served through a pool of its one
+// database as well, so that it can be swapped for a fresh one when its
+// file is replaced.
+
+const (
+	defaultMaxDatabases = 64
+
+	// how long an evicted database stays open for the requests still
+	// reading from it
+	evictGrace = time.Minute
+)
+
+// perRequestPath reports whether dbPath, with the placeholders known at
+// provisioning replaced, names a database for each request.
+func perRequestPath(dbPath string) bool {
+	return strings.Contains(dbPath, "{")
+}
+
+// dbPool holds the databases of a per-request db_path, most recently used
+// first.
+type dbPool struct {
+	ctx    caddy.Context
+	base   SQLiteFS // config of each database
+	path   string
+	max    int
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	open   map[string]*list.Element // of *pooledDB, by path
+	lru    list.List
+	closed bool
+	done   chan struct{} // closed with the pool
+}
+
+type pooledDB struct {
+	path   string
+	fsys   *SQLiteFS
+	opened os.FileInfo // of the file when it was opened
+}
+
+func newDBPool(ctx caddy.Context, base SQLiteFS, max int, logger *zap.Logger) *dbPool {
+	if max <= 0 {
+		max = defaultMaxDatabases
+	}
+	// each database has its own, opened like a static db_path
+	base.Mounts, base.MaxDatabases = nil, 0
+	base.FallbackRaw, base.FallbackRoot = nil, ""
+	base.Watch = 0
+	return &dbPool{
+		ctx:    ctx,
+		base:   base,
+		path:   base.DBPath,
+		max:    max,
+		logger: logger,
+		open:   make(map[string]*list.Element),
+		done:   make(chan struct{}),
+	}
+}
+
+// errPathValue is returned for requests whose placeholder values can't be
+// part of a file name.
+var errPathValue = errors.New("placeholder value can't be part of a database path")
+
+// resolve returns the database path of the request of ctx. Values of
+// placeholders must be plain file name parts, so a request can't point it
+// at another directory.
+func (p *dbPool) resolve(ctx context.Context) (string, error) {
+	return replacer(ctx).ReplaceFunc(p.path, func(key string, val any) (any, error) {
+		v := caddy.ToString(val)
+		if v == "" || strings.ContainsAny(v, "/\\\x00") || strings.Contains(v, "..") {
+			return nil, errPathValue
+		}
+		return v, nil
+	})
+}
+
+// get returns the file system of the database of the request of ctx,
+// opening it if it isn't yet. Databases that don't exist aren't created.
+func (p *dbPool) get(ctx context.Context) (SQLiteFS, error) {
+	path, err := p.resolve(ctx)
+	if err != nil {
+		return SQLiteFS{}, fs.ErrNotExist
+	}
+	p.mu.Lock()
+	if el, ok := p.open[path]; ok {
+		p.lru.MoveToFront(el)
+		fsys := el.Value.(*pooledDB).fsys
+		p.mu.Unlock()
+		return *fsys, nil
+	}
+	p.mu.Unlock()
+
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return SQLiteFS{}, fs.ErrNotExist
+		}
+		return SQLiteFS{}, fmt.Errorf("%w: %w", ErrDatabase, err)
+	}
+	return p.load(path)
+}
+
+// provision opens the database at path with the config of the pool.
+func (p *dbPool) provision(path string) (*pooledDB, error) {
+	opened, _ := os.Stat(path)
+	fsys := p.base
+	fsys.DBPath = path
+	err := fsys.Provision(p.ctx)
+	if err == nil {
+		err = fsys.Validate()
+	}
+	if err != nil {
+		fsys.Cleanup()
+		p.logger.Error("opening database", zap.String("db_path", path), zap.Error(err))
+		return nil, fmt.Errorf("%w: %w", ErrDatabase, err)
+	}
+	return &pooledDB{path: path, fsys: &fsys, opened: opened}, nil
+}
+
+// load opens the database at path and adds it to the pool, unless
+// another request did meanwhile.
+func (p *dbPool) load(path string) (SQLiteFS, error) {
+	// opened without the lock, so a slow open doesn't hold up the others
+	db, err := p.provision(path)
+	if err != nil {
+		return SQLiteFS{}, err
+	}
+	fsys := db.fsys
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if el, ok := p.open[path]; ok {
+		// opened by another request meanwhile
+		fsys.Cleanup()
+		p.lru.MoveToFront(el)
+		return *el.Value.(*pooledDB).fsys, nil
+	}
+	if p.closed {
+		fsys.Cleanup()
+		return SQLiteFS{}, fmt.Errorf("%w: %w", ErrDatabase, errNotOpen)
+	}
+	p.open[path] = p.lru.PushFront(db)
+	for len(p.open) > p.max {
+		old := p.lru.Remove(p.lru.Back()).(*pooledDB)
+		delete(p.open, old.path)
+		time.AfterFunc(evictGrace, func() { old.fsys.Cleanup() })
+	}
+	return *fsys, nil
+}
+
+// startWatch checks the files of the open databases every interval, and
+// swaps those that were replaced, as by a deploy renaming a new database
+// over the old one, for the new file. Requests that got the old one keep
+// reading from it for evictGrace, and a new file that fails to open
+// leaves the old one served until the next check.
+func (p *dbPool) startWatch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-p.done:
+				return
+			}
+			p.mu.Lock()
+			dbs := make([]*pooledDB, 0, len(p.open))
+			for _, el := range p.open {
+				dbs = append(dbs, el.Value.(*pooledDB))
+			}
+			p.mu.Unlock()
+			for _, db := range dbs {
+				// one that is missing was moved away rather than replaced
+				info, err := os.Stat(db.path)
+				if err == nil && (db.opened == nil || !os.SameFile(db.opened, info)) {
+					p.swap(db)
+				}
+			}
+		}
+	}()
+}
+
+// swap opens the file at the path of old and serves it in its place.
+func (p *dbPool) swap(old *pooledDB) {
+	db, err := p.provision(old.path)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	el, ok := p.open[old.path]
+	if p.closed || !ok || el.Value != old {
+		// closed or evicted meanwhile
+		db.fsys.Cleanup()
+		return
+	}
+	el.Value = db
+	p.logger.Info("database file was replaced, serving the new one", zap.String("db_path", old.path))
+	time.AfterFunc(evictGrace, func() { old.fsys.Cleanup() })
+}
+
+// close closes every database of p.
+func (p *dbPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		close(p.done)
+	}
+	p.closed = true
+	for _, el := range p.open {
+		el.Value.(*pooledDB).fsys.Cleanup()
+	}
+	p.open = make(map[string]*list.Element)
+	p.lru.Init()
+}
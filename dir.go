@@ -0,0 +1,299 @@
+package sqlitefs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Directories are rows whose mode has fs.ModeDir set, or are implied by the
+// names of the files below them, so a table of plain files can be listed
+// without a row for each directory. The root "." always exists.
+
+// ReadDir implements fs.ReadDirFS.
+func (s SQLiteFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return s.ReadDirContext(context.Background(), name)
+}
+
+// ReadDirContext lists the directory name for the request ctx belongs to,
+// sorted by name, with at most MaxListEntries entries.
+func (s SQLiteFS) ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if s.fallback != nil {
+		entries, err := s.primary().ReadDirContext(ctx, name)
+		if s.fallsBack(err) {
+			return s.fallbackReadDir(ctx, name)
+		}
+		return entries, err
+	}
+	if m, rest := s.mounted(name); m != nil {
+		entries, err := m.fsys.ReadDirContext(ctx, rest)
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			pathErr.Path = name
+		}
+		return entries, err
+	}
+	if s.pool != nil {
+		fsys, err := s.pool.get(ctx)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		return fsys.ReadDirContext(ctx, name)
+	}
+	stored := s.normalizeName(name)
+	entries, err := s.readDir(ctx, stored)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if len(entries) == 0 && stored != "." {
+		// empty directories only exist as rows
+		info, err := s.statContext(ctx, stored)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		if !info.IsDir() {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+		}
+	}
+	return entries, nil
+}
+
+// readDir returns the entries of the directory name from the rows below it
+// and VirtualFiles.
+func (s SQLiteFS) readDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	release, err := s.startExpensive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	children := make(map[string]*sqliteFileInfo)
+	implied := make(map[string]bool)
+	add := func(full string, info sqliteFileInfo) bool {
+		rest := strings.TrimPrefix(full, prefix)
+		child, _, below := strings.Cut(rest, "/")
+		if below {
+			// a file further down implies a directory, as new as its
+			// newest file
+			info = sqliteFileInfo{name: prefix + child, mode: fs.ModeDir | 0o555, modTime: info.modTime}
+		}
+		if rest == "" || !s.nameAllowed(info.name) {
+			return true
+		}
+		if seen, ok := children[child]; ok {
+			// the first row of a name is the one served
+			if below && implied[child] && info.modTime.After(seen.modTime) {
+				seen.modTime = info.modTime
+			}
+			return true
+		}
+		if s.MaxListEntries > 0 && len(children) >= s.MaxListEntries {
+			return false
+		}
+		children[child] = &info
+		implied[child] = below
+		return true
+	}
+
+	for full, content := range s.VirtualFiles {
+		if strings.HasPrefix(full, prefix) {
+			add(full, sqliteFileInfo{name: full, size: int64(len(content)), modTime: s.provisioned, mode: 0o444})
+		}
+	}
+	s.mountsBelow(prefix, func(full string) {
+		add(full, sqliteFileInfo{name: full, modTime: s.provisioned, mode: fs.ModeDir | 0o555})
+	})
+	if err := s.usable(); err != nil {
+		return nil, err
+	}
+	rowsPrefix := s.rootName(name) + "/"
+	if rowsPrefix == "./" {
+		rowsPrefix = ""
+	}
+	err = s.readDirRows(ctx, rowsPrefix, "", func(full string, info sqliteFileInfo) bool {
+		return add(prefix+strings.TrimPrefix(full, rowsPrefix), s.rootInfo(info))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, info := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(*info))
+	}
+	less := func(a, b string) bool { return a < b }
+	if s.Collation != nil {
+		col, err := s.Collation.collator()
+		if err != nil {
+			return nil, err
+		}
+		less = func(a, b string) bool { return col.CompareString(a, b) < 0 }
+	}
+	sort.Slice(entries, func(i, j int) bool { return less(entries[i].Name(), entries[j].Name()) })
+	return entries, nil
+}
+
+// readDirRows passes the visible rows below prefix, and with a glob only
+// those it or its directory pattern matches, to add, in the order of the
+// listing, until it returns false. Of the rows sharing a name, the one
+// that would be served comes first.
+func (s SQLiteFS) readDirRows(ctx context.Context, prefix, glob string, add func(string, sqliteFileInfo) bool) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+	filter, args, ok := s.rowFilter(ctx)
+	if !ok {
+		return nil
+	}
+	where, whereArgs := "1", []any(nil)
+	if prefix != "" {
+		// a range rather than substr, so the primary key index is used;
+		// "0" is the byte after "/"
+		where, whereArgs = "name>=? AND name<?", []any{prefix, strings.TrimSuffix(prefix, "/") + "0"}
+	}
+	if glob != "" {
+		// rows below a matching directory imply it
+		where += " AND (name GLOB ? OR name GLOB ?)"
+		whereArgs = append(whereArgs, glob, glob+"/*")
+	}
+	order := "name"
+	if s.Collation != nil {
+		order = "name COLLATE " + s.Collation.sqlName()
+	}
+	latest, orderArgs := s.latestFirst(ctx)
+	if latest != "" {
+		order += ", " + strings.TrimPrefix(latest, " ORDER BY ")
+	}
+	start := time.Now()
+	defer s.metrics.queried("readdir", start)
+	rows, err := s.db.QueryContext(ctx, "SELECT name, "+s.sizeColumn()+", modified, mode FROM files WHERE "+where+" AND "+filter+" ORDER BY "+order,
+		append(append(whereArgs, args...), orderArgs...)...)
+	if err != nil {
+		return s.dbError("readdir", prefix, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var size, modified, mode *int64
+		if err := rows.Scan(&name, &size, &modified, &mode); err != nil {
+			return s.dbError("readdir", prefix, err)
+		}
+		info := sqliteFileInfo{name: name}
+		if size != nil {
+			info.size = *size
+		}
+		if modified != nil {
+			info.modTime = time.Unix(*modified, 0)
+		}
+		if mode != nil {
+			info.mode = fs.FileMode(*mode)
+		}
+		if !add(name, info) {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return s.dbError("readdir", prefix, err)
+	}
+	return nil
+}
+
+// impliedDir returns the directory name that files below it imply.
+func (s SQLiteFS) impliedDir(ctx context.Context, name string) (fs.File, bool) {
+	info, ok := s.impliedDirInfo(ctx, name)
+	if !ok {
+		return nil, false
+	}
+	return &sqliteDir{fsys: s, ctx: ctx, info: info}, true
+}
+
+// impliedDirInfo returns the FileInfo of the directory name if files below
+// it imply one. Its modification time is that of its newest file.
+func (s SQLiteFS) impliedDirInfo(ctx context.Context, name string) (sqliteFileInfo, bool) {
+	info := sqliteFileInfo{name: name, mode: fs.ModeDir | 0o555}
+	if name == s.rootName(".") {
+		return info, true
+	}
+	if !s.nameAllowed(name) {
+		return info, false
+	}
+	prefix := name + "/"
+	found := false
+	for full := range s.VirtualFiles {
+		if strings.HasPrefix(full, prefix) {
+			info.modTime, found = s.provisioned, true
+		}
+	}
+	s.mountsBelow(prefix, func(string) { info.modTime, found = s.provisioned, true })
+	if s.db == nil {
+		return info, found
+	}
+	filter, args, ok := s.rowFilter(ctx)
+	if !ok {
+		return info, found
+	}
+	var newest *int64
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+	err := s.db.QueryRowContext(ctx, "SELECT max(coalesce(modified, 0)) FROM files WHERE name>=? AND name<? AND "+filter,
+		append([]any{prefix, name + "0"}, args...)...).Scan(&newest)
+	if err != nil || newest == nil {
+		return info, found
+	}
+	if t := time.Unix(*newest, 0); *newest != 0 && t.After(info.modTime) {
+		info.modTime = t
+	}
+	return info, true
+}
+
+// sqliteDir is an open directory, which fs.ReadDirFile consumers such as
+// file_server's browse list.
+type sqliteDir struct {
+	fsys SQLiteFS
+	ctx  context.Context
+	info sqliteFileInfo
+
+	entries []fs.DirEntry // nil until the first ReadDir
+	offset  int
+}
+
+func (d *sqliteDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *sqliteDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+func (d *sqliteDir) Close() error { return nil }
+
+// ReadDir implements fs.ReadDirFile.
+func (d *sqliteDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		entries, err := d.fsys.readDir(d.ctx, d.info.name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.info.name, Err: err}
+		}
+		d.entries = entries
+	}
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
@@ -0,0 +1,245 @@
+package sqlitefs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "sqlitefs",
+		Short: "Tools for sqlite file systems",
+		CobraFunc: func(cmd *cobra.Command) {
+			doctor := &cobra.Command{
+				Use:   "doctor [--config <path> [--adapter <name>]] [<db_path>...]",
+				Short: "Checks the databases of a config before deploying it",
+				Long: `
+Loads a config (the Caddyfile in the current directory by default), finds
+the databases its sqlite modules use, and checks that each exists, is
+readable, has a usable files table with an index on name, and passes a
+quick integrity check. Databases may also be given as arguments.
+
+Exits with a failure status if any check fails, so it can gate deploys.`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdDoctor),
+			}
+			doctor.Flags().StringP("config", "c", "", "Configuration file")
+			doctor.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			cmd.AddCommand(doctor)
+
+			imp := &cobra.Command{
+				Use:   "import [--prefix <prefix>] [--ttl <duration>] [--dataset <label>] [--fingerprint] [--images <formats>] <dir> <db_path>",
+				Short: "Packs a directory into a database",
+				Long: `
+Walks a local directory and writes its files, with their modes and
+modification times, into the files table of a database, creating the
+database and the schema if they are missing. Files already there are
+replaced, or get a new version in a table with a version column.
+
+--prefix puts the files below a directory of the database, --ttl makes
+them expire that long after the import, and --dataset writes them to that
+dataset label. --fingerprint stores stylesheets, scripts, images and other
+assets under names with a hash of their content and points the references
+of pages and stylesheets at them. --images optimizes PNG images and adds
+renditions in the comma separated formats (webp, avif) as variants.`,
+				Args: cobra.ExactArgs(2),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdImport),
+			}
+			imp.Flags().String("prefix", "", "Directory of the database to import into")
+			imp.Flags().String("ttl", "", "Time after which the imported files expire")
+			imp.Flags().String("dataset", "", "Dataset label to import into")
+			imp.Flags().Bool("fingerprint", false, "Fingerprint the names of assets")
+			imp.Flags().String("images", "", "Image renditions to add, such as webp,avif")
+			cmd.AddCommand(imp)
+
+			export := &cobra.Command{
+				Use:   "export [--prefix <prefix>] [--dataset <label>] <db_path> <dir>",
+				Short: "Writes the files of a database to a directory",
+				Long: `
+Writes the files a database serves to a local directory, creating it if
+needed, with their modes and modification times, and symlinks as symlinks.
+Files that are expired, deleted or otherwise hidden are left out.
+
+--prefix exports only the files below a directory of the database, and
+--dataset those of that dataset label.`,
+				Args: cobra.ExactArgs(2),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdExport),
+			}
+			export.Flags().String("prefix", "", "Directory of the database to export")
+			export.Flags().String("dataset", "", "Dataset label to export")
+			cmd.AddCommand(export)
+		},
+	})
+}
+
+func cmdDoctor(fl caddycmd.Flags) (int, error) {
+	dbPaths := fl.Args()
+	if len(dbPaths) == 0 {
+		config, _, err := caddycmd.LoadConfig(fl.String("config"), fl.String("adapter"))
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		var cfg any
+		if err := json.Unmarshal(config, &cfg); err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding config: %w", err)
+		}
+		dbPaths = configDBPaths(cfg)
+	}
+	if len(dbPaths) == 0 {
+		return caddy.ExitCodeFailedStartup, errors.New("no sqlite databases found in the config")
+	}
+
+	failed := 0
+	for _, dbPath := range dbPaths {
+		fmt.Println(dbPath)
+		for _, c := range checkDatabase(dbPath) {
+			status := "ok  "
+			if c.err != nil {
+				status = "FAIL"
+				failed++
+			} else if c.warn {
+				status = "warn"
+			}
+			fmt.Printf("  %s  %s\n", status, c.msg)
+		}
+	}
+	if failed > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d checks failed", failed)
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// configDBPaths returns the db_path of every sqlite file system in a JSON
+// config, wherever it is nested.
+func configDBPaths(v any) []string {
+	seen := make(map[string]bool)
+	var walk func(any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if p, ok := v["db_path"].(string); ok && p != "" && v["backend"] == "sqlite" {
+				seen[p] = true
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(v)
+
+	paths := make([]string, 0, len(seen))
+	for p := range seen {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+type check struct {
+	msg  string
+	warn bool
+	err  error
+}
+
+// checkDatabase runs the doctor checks on one database, stopping at the
+// first failure that makes the rest meaningless.
+func checkDatabase(dbPath string) []check {
+	var checks []check
+	fail := func(msg string, err error) []check {
+		return append(checks, check{msg: fmt.Sprintf("%s: %v", msg, err), err: err})
+	}
+
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		return fail("database file", err)
+	}
+	size := humanize.IBytes(uint64(info.Size()))
+	if wal, err := os.Stat(dbPath + "-wal"); err == nil {
+		size += fmt.Sprintf(" (+%s WAL)", humanize.IBytes(uint64(wal.Size())))
+	}
+	checks = append(checks, check{msg: fmt.Sprintf("exists, %s, %s", size, info.Mode())})
+
+	f, err := os.Open(dbPath)
+	if err != nil {
+		return fail("reading", err)
+	}
+	header := make([]byte, 16)
+	_, err = f.Read(header)
+	f.Close()
+	if err != nil || string(header) != "SQLite format 3\x00" {
+		return fail("reading", errors.New("not a sqlite database"))
+	}
+
+	db, err := defaultDriver.open(dbPath, dsnOptions{readOnly: true}, nil)
+	if err != nil {
+		return fail("opening", err)
+	}
+	defer db.Close()
+
+	columns, err := tableColumns(db, "files")
+	if err != nil {
+		return fail("files table", err)
+	}
+	if len(columns) == 0 {
+		return fail("files table", errors.New("missing"))
+	}
+	var missing, optional []string
+	for _, c := range []string{"name", "content", "modified", "mode"} {
+		if !columns[c] {
+			missing = append(missing, c)
+		}
+		delete(columns, c)
+	}
+	if len(missing) > 0 {
+		return fail("files table", fmt.Errorf("missing columns %s", strings.Join(missing, ", ")))
+	}
+	for c := range columns {
+		optional = append(optional, c)
+	}
+	sort.Strings(optional)
+	msg := "files table"
+	if len(optional) > 0 {
+		msg += ", with " + strings.Join(optional, ", ")
+	}
+	checks = append(checks, check{msg: msg})
+
+	var indexed int
+	err = db.QueryRow(`SELECT count(*) FROM pragma_index_list('files') AS l
+		JOIN pragma_index_info(l.name) AS i WHERE i.seqno = 0 AND i.name = 'name'`).Scan(&indexed)
+	if err != nil {
+		return fail("indexes", err)
+	}
+	if indexed == 0 {
+		checks = append(checks, check{msg: "name is not indexed, every lookup scans the table", warn: true})
+	} else {
+		checks = append(checks, check{msg: "name is indexed"})
+	}
+
+	var journal string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&journal); err != nil {
+		return fail("pragmas", err)
+	}
+	checks = append(checks, check{msg: "journal_mode " + journal, warn: journal != "wal"})
+
+	var result string
+	if err := db.QueryRow("PRAGMA quick_check(1)").Scan(&result); err != nil {
+		return fail("quick_check", err)
+	}
+	if result != "ok" {
+		return fail("quick_check", errors.New(result))
+	}
+	checks = append(checks, check{msg: "quick_check ok"})
+	return checks
+}
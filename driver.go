@@ -0,0 +1,262 @@
+package sqlitefs
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+	"modernc.org/sqlite"
+)
+
+// sqliteDriver is one of the sqlite drivers for database/sql. Connection
+// strings and connect hooks are adapted to each, so both behave the same.
+type sqliteDriver string
+
+const (
+	// github.com/mattn/go-sqlite3, which needs cgo
+	driverMattn sqliteDriver = "mattn"
+
+	// modernc.org/sqlite, sqlite translated to Go, for builds without cgo
+	driverModernc sqliteDriver = "modernc"
+)
+
+// parseDriver returns the driver of the driver option, by default mattn in
+// builds with cgo and modernc in builds without.
+func parseDriver(name string) (sqliteDriver, error) {
+	switch name {
+	case "":
+		return defaultDriver, nil
+	case string(driverMattn):
+		if !haveCgo {
+			return "", errors.New("the mattn driver needs a build with cgo, use modernc")
+		}
+		return driverMattn, nil
+	case string(driverModernc):
+		return driverModernc, nil
+	}
+	return "", fmt.Errorf("unknown driver %q", name)
+}
+
+// sqliteDriver returns the driver of s.
+func (s SQLiteFS) sqliteDriver() sqliteDriver {
+	d, err := parseDriver(s.Driver)
+	if err != nil {
+		// refused by Validate
+		return defaultDriver
+	}
+	return d
+}
+
+// connSetup returns the setup of the connections of s, nil if they need
+// none: the key, the collation, the pragmas and the files view of another
+// layout.
+func (s SQLiteFS) connSetup() (*connSetup, error) {
+	var keys []string
+	setup := &connSetup{collation: s.Collation}
+	if s.key != "" {
+		// before any hook reads the database
+		key, hook := keyHook(s.key, !s.readOnly)
+		keys, setup.hooks, setup.keyed = append(keys, key), append(setup.hooks, hook), true
+	}
+	if s.Collation != nil {
+		if _, err := s.Collation.collator(); err != nil {
+			return nil, err
+		}
+		keys = append(keys, s.Collation.sqlName())
+	}
+	if len(s.Pragmas) > 0 {
+		key, hook, err := s.pragmaHook()
+		if err != nil {
+			return nil, err
+		}
+		keys, setup.hooks = append(keys, key), append(setup.hooks, hook)
+	}
+	if s.mapsLayout() {
+		key, hook := s.filesView()
+		keys, setup.hooks = append(keys, key), append(setup.hooks, hook)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	setup.key = strings.Join(keys, "_")
+	return setup, nil
+}
+
+// dsnOptions are how a database is opened.
+type dsnOptions struct {
+	readOnly  bool // mode=ro, rather than read-write in WAL mode
+	immutable bool // with readOnly: the file doesn't change while open
+	exclusive bool // locking_mode EXCLUSIVE
+}
+
+// sqliteConn is a new connection of either driver, for connect hooks.
+type sqliteConn interface {
+	driver.ExecerContext
+	driver.QueryerContext
+}
+
+// connSetup is what the new connections of a file system get: a
+// collation and hooks, told apart from other setups by key.
+type connSetup struct {
+	key       string
+	collation *Collation
+	hooks     []func(sqliteConn) error
+	keyed     bool // the hooks set the journal mode, after the key
+}
+
+var (
+	hookedMu         sync.Mutex
+	hookedDrivers    = make(map[string]bool)
+	moderncSetups    = make(map[string]connSetup)
+	moderncCollation = make(map[string]bool)
+)
+
+// setupParam is the connection string parameter by which the connect hook
+// of modernc finds the setup of a connection. sqlite ignores it.
+const setupParam = "_sqlitefs_setup"
+
+func init() {
+	// modernc only has hooks and collations for all connections, which
+	// this dispatches to the setup the connection string names
+	sqlite.RegisterConnectionHook(func(conn sqlite.ExecQuerierContext, dsn string) error {
+		_, query, _ := strings.Cut(dsn, "?")
+		q, _ := url.ParseQuery(query)
+		key := q.Get(setupParam)
+		if key == "" {
+			return nil
+		}
+		hookedMu.Lock()
+		setup := moderncSetups[key]
+		hookedMu.Unlock()
+		for _, hook := range setup.hooks {
+			if err := hook(conn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// open opens path with o, waiting up to 5s on locks held by other
+// connections, and with setup if it isn't nil. The handle connects lazily.
+func (d sqliteDriver) open(path string, o dsnOptions, setup *connSetup) (*sql.DB, error) {
+	name, dsn, err := d.source(path, o, setup)
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open(name, dsn)
+}
+
+// source returns the database/sql driver name and connection string of
+// open, for handles opened elsewhere.
+func (d sqliteDriver) source(path string, o dsnOptions, setup *connSetup) (string, string, error) {
+	var dsn string
+	switch {
+	case o.readOnly:
+		dsn = "file:" + path + "?mode=ro"
+		if o.immutable {
+			dsn += "&immutable=1"
+		}
+	case d == driverModernc:
+		dsn = path + "?_pragma=busy_timeout(5000)"
+		if setup == nil || !setup.keyed {
+			dsn += "&_pragma=journal_mode(WAL)"
+		}
+		if o.exclusive {
+			dsn += "&_pragma=locking_mode(EXCLUSIVE)"
+		}
+	default:
+		// mattn waits 5s by default
+		var params []string
+		if setup == nil || !setup.keyed {
+			params = append(params, "_journal=WAL")
+		}
+		if o.exclusive {
+			params = append(params, "_locking_mode=EXCLUSIVE")
+		}
+		dsn = path + "?" + strings.Join(params, "&")
+	}
+
+	if d == driverModernc {
+		if setup == nil {
+			return "sqlite", dsn, nil
+		}
+		if err := registerModernc(*setup); err != nil {
+			return "", "", err
+		}
+		return "sqlite", dsn + "&" + setupParam + "=" + url.QueryEscape(setup.key), nil
+	}
+	if setup == nil {
+		return "sqlite3", dsn, nil
+	}
+	return registerMattn(*setup), dsn, nil
+}
+
+// registerMattn returns the name of a mattn driver whose connections get
+// setup, registering it on first use.
+func registerMattn(setup connSetup) string {
+	name := "sqlite3_" + setup.key
+	hookedMu.Lock()
+	defer hookedMu.Unlock()
+	if hookedDrivers[name] {
+		return name
+	}
+	sql.Register(name, &sqlite3.SQLiteDriver{
+		ConnectHook: func(c *sqlite3.SQLiteConn) error {
+			if setup.collation != nil {
+				// collators aren't safe for concurrent use, connections are
+				// only used by one goroutine at a time
+				col, err := setup.collation.collator()
+				if err != nil {
+					return err
+				}
+				if err := c.RegisterCollation(setup.collation.sqlName(), col.CompareString); err != nil {
+					return err
+				}
+			}
+			conn, ok := any(c).(sqliteConn)
+			if !ok {
+				return errors.New("the mattn driver needs a build with cgo")
+			}
+			for _, hook := range setup.hooks {
+				if err := hook(conn); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+	hookedDrivers[name] = true
+	return name
+}
+
+// registerModernc makes setup known to the connect hook of modernc, and
+// registers its collation for all connections.
+func registerModernc(setup connSetup) error {
+	hookedMu.Lock()
+	defer hookedMu.Unlock()
+	moderncSetups[setup.key] = setup
+	if c := setup.collation; c != nil && !moderncCollation[c.sqlName()] {
+		col, err := c.collator()
+		if err != nil {
+			return err
+		}
+		// shared by all connections, unlike with mattn
+		var mu sync.Mutex
+		err = sqlite.RegisterCollationUtf8(c.sqlName(), func(a, b string) int {
+			mu.Lock()
+			defer mu.Unlock()
+			return col.CompareString(a, b)
+		})
+		if err != nil {
+			return err
+		}
+		moderncCollation[c.sqlName()] = true
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build cgo
+
+package sqlitefs
+
+const (
+	defaultDriver = driverMattn
+	haveCgo       = true
+)
@@ -0,0 +1,8 @@
+//go:build !cgo
+
+package sqlitefs
+
+const (
+	defaultDriver = driverModernc
+	haveCgo       = false
+)
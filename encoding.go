@@ -0,0 +1,31 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+)
+
+// decodeContent turns content stored with encoding back into the bytes
+// of the file.
+func decodeContent(encoding string, content []byte) ([]byte, error) {
+	switch encoding {
+	case "", "raw":
+		return content, nil
+	case "base64":
+		// tolerate line breaks and missing padding left by other tools
+		content = bytes.Join(bytes.Fields(content), nil)
+		enc := base64.StdEncoding
+		if len(content)%4 != 0 {
+			enc = base64.RawStdEncoding
+		}
+		out := make([]byte, enc.DecodedLen(len(content)))
+		n, err := enc.Decode(out, content)
+		if err != nil {
+			return nil, fmt.Errorf("decoding base64 content: %w", err)
+		}
+		return out[:n], nil
+	default:
+		return nil, fmt.Errorf("unknown content encoding %q", encoding)
+	}
+}
@@ -0,0 +1,211 @@
+package sqlitefs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(ETagHandler{})
+	httpcaddyfile.RegisterHandlerDirective("sqlite_etag", parseETagHandler)
+}
+
+// etag returns the entity tag of the file: the one stored in its etag
+// column, its stored content hash, or the modification time and size like
+// Caddy's file_server when it has neither. Files with none of them have no
+// tag.
+func (fi sqliteFileInfo) etag() string {
+	if fi.tag != "" {
+		return fi.tag
+	}
+	if fi.hash != "" {
+		return `"` + fi.hash + `"`
+	}
+	if fi.modTime.IsZero() {
+		return ""
+	}
+	return `"` + strconv.FormatInt(fi.modTime.Unix(), 36) + strconv.FormatInt(fi.size, 36) + `"`
+}
+
+// storedETag returns the value of an etag column as an entity tag, quoted
+// unless it already is, so columns can hold plain checksums such as the
+// SHA-256 of the content in hex.
+func storedETag(v string) string {
+	if v = strings.TrimSpace(v); v == "" || strings.HasPrefix(v, `"`) || strings.HasPrefix(v, `W/"`) {
+		return v
+	}
+	return `"` + v + `"`
+}
+
+// contentETag returns the value writes store in an etag column: the
+// SHA-256 of content in hex.
+func contentETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodedETag returns the entity tag of the file sent compressed with
+// encoding as it is stored, which is another representation of it.
+func (fi sqliteFileInfo) encodedETag(encoding string) string {
+	etag := fi.etag()
+	if etag == "" {
+		return ""
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// ETagHandler answers conditional requests for files of a sqlite file
+// system from their stored metadata, before a file server after it opens
+// them: 304 for a matching If-None-Match and 412 for a failed If-Match.
+// Other requests pass on with the ETag header set, which file_server and
+// sqlite_file_server keep, so the tag doesn't change when modification
+// times do after a database is rebuilt.
+type ETagHandler struct {
+	// The sqlite file system the files are served from.
+	FileSystemRaw json.RawMessage `json:"file_system,omitempty" caddy:"namespace=caddy.fs inline_key=backend"`
+
+	// Names of files to try for requests ending in a slash. Default: index.html.
+	IndexNames []string `json:"index_names,omitempty"`
+
+	fsys *SQLiteFS
+}
+
+// CaddyModule returns the Caddy module information.
+func (ETagHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.sqlite_etag",
+		New: func() caddy.Module { return new(ETagHandler) },
+	}
+}
+
+func (h *ETagHandler) Provision(ctx caddy.Context) error {
+	fsys, err := loadFileSystem(ctx, h, h.FileSystemRaw)
+	if err != nil {
+		return err
+	}
+	h.fsys = fsys
+	if len(h.IndexNames) == 0 {
+		h.IndexNames = []string{"index.html"}
+	}
+	return nil
+}
+
+func (h *ETagHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+
+	var info sqliteFileInfo
+	var err error
+	for _, name := range requestNames(r, h.IndexNames) {
+		info, err = h.fsys.statContext(r.Context(), name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil || info.IsDir() {
+		if ifMatch != "" && errors.Is(err, fs.ErrNotExist) {
+			// nothing to match
+			return caddyhttp.Error(http.StatusPreconditionFailed, nil)
+		}
+		return next.ServeHTTP(w, r)
+	}
+
+	etag := w.Header().Get("Etag")
+	if etag == "" {
+		if etag = info.etag(); etag == "" {
+			return next.ServeHTTP(w, r)
+		}
+		w.Header().Set("Etag", etag)
+	}
+	if ifMatch != "" && !etagListMatches(ifMatch, etag, false) {
+		return caddyhttp.Error(http.StatusPreconditionFailed, nil)
+	}
+	if ifNoneMatch != "" && etagListMatches(ifNoneMatch, etag, true) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+		return caddyhttp.Error(http.StatusPreconditionFailed, nil)
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// etagListMatches reports whether the If-Match or If-None-Match header
+// value list matches etag, comparing weakly (ignoring W/) if weak is set.
+func etagListMatches(list, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if candidate == etag && !strings.HasPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseETagHandler sets up the handler from Caddyfile tokens. Syntax:
+//
+//	sqlite_etag [<matcher>] [<db_path>] {
+//		fs    sqlite <db_path>
+//		index <filenames...>
+//	}
+func parseETagHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	eh := new(ETagHandler)
+	err := eh.UnmarshalCaddyfile(h.Dispenser)
+	return eh, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (h *ETagHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			h.FileSystemRaw = caddyconfig.JSONModuleObject(&SQLiteFS{DBPath: adaptDBPath(d, d.Val())}, "backend", "sqlite", nil)
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "fs":
+				if err := unmarshalFileSystem(d, &h.FileSystemRaw); err != nil {
+					return err
+				}
+			case "index":
+				h.IndexNames = d.RemainingArgs()
+				if len(h.IndexNames) == 0 {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unrecognized parameter '%s'", d.Val())
+			}
+		}
+	}
+	if h.FileSystemRaw == nil {
+		return d.Err("missing file system")
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddyhttp.MiddlewareHandler = (*ETagHandler)(nil)
+	_ caddy.Provisioner           = (*ETagHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*ETagHandler)(nil)
+)
@@ -0,0 +1,130 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+func init() {
+	caddy.RegisterModule(EventHandler{})
+}
+
+// EventHandler records the events it is subscribed to in a sqlite table,
+// keeping an audit trail next to the content.
+type EventHandler struct {
+	DBPath string `json:"db_path,omitempty"`
+
+	// Table to record events in, created if missing. Default: events.
+	Table string `json:"table,omitempty"`
+
+	db     *sql.DB
+	insert string
+}
+
+// CaddyModule returns the Caddy module information.
+func (EventHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "events.handlers.sqlite",
+		New: func() caddy.Module { return new(EventHandler) },
+	}
+}
+
+func (h *EventHandler) Provision(ctx caddy.Context) error {
+	if h.Table == "" {
+		h.Table = "events"
+	}
+	db, err := openSQLite(h.DBPath)
+	if err != nil {
+		return err
+	}
+	table := quoteIdent(h.Table)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (
+		"id" TEXT PRIMARY KEY,
+		"ts" INTEGER,       -- unix timestamp in nanoseconds
+		"name" TEXT,
+		"origin" TEXT,      -- module ID of the emitter
+		"data" TEXT         -- JSON payload
+	);
+	CREATE INDEX IF NOT EXISTS ` + quoteIdent(h.Table+"_name_ts") + ` ON ` + table + ` ("name", "ts")`)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("creating events table: %w", err)
+	}
+	h.db = db
+	h.insert = "INSERT OR IGNORE INTO " + table + " (id, ts, name, origin, data) VALUES (?, ?, ?, ?, ?)"
+	return nil
+}
+
+func (h *EventHandler) Cleanup() error {
+	if h.db != nil {
+		return h.db.Close()
+	}
+	return nil
+}
+
+func (h *EventHandler) Validate() error {
+	if h.DBPath == "" {
+		return errors.New("db_path is required")
+	}
+	return nil
+}
+
+// Handle implements caddyevents.Handler. Failing to record an event is
+// returned to the emitter but never aborts it.
+func (h *EventHandler) Handle(ctx context.Context, e caddyevents.Event) error {
+	ce := e.CloudEvent()
+	_, err := h.db.ExecContext(ctx, h.insert, ce.ID, ce.Time.UnixNano(), ce.Type, ce.Source, string(ce.Data))
+	if err != nil {
+		return fmt.Errorf("recording event %s: %w", ce.Type, err)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	sqlite <db_path> {
+//		table <name>
+//	}
+func (h *EventHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			h.DBPath = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "db_path":
+				if !d.AllArgs(&h.DBPath) {
+					return d.ArgErr()
+				}
+			case "table":
+				if !d.AllArgs(&h.Table) {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unrecognized parameter '%s'", d.Val())
+			}
+		}
+	}
+	if h.DBPath == "" {
+		return d.Err("missing db_path")
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddyevents.Handler   = (*EventHandler)(nil)
+	_ caddy.Provisioner     = (*EventHandler)(nil)
+	_ caddy.CleanerUpper    = (*EventHandler)(nil)
+	_ caddy.Validator       = (*EventHandler)(nil)
+	_ caddyfile.Unmarshaler = (*EventHandler)(nil)
+)
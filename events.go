@@ -0,0 +1,47 @@
+package sqlitefs
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+// File systems loaded in a config emit events through Caddy's events app,
+// each with the name and db_path they are about, so handlers can alert on
+// them or fetch missing content:
+//
+//	sqlitefs.miss            an open of a name the database has no row for
+//	sqlitefs.db_error        a failed query, with its op and error
+//	sqlitefs.expired_served  an open of an expired row within StaleGrace,
+//	                         with its expired_at
+//	sqlitefs.expired_denied  a lookup of a name whose row expired, with
+//	                         Expired "gone"
+//
+// expired_served and expired_denied are the two outcomes of what could be
+// one sqlitefs.expired_served_denied event, apart so handlers subscribe to
+// the one they care about. Without "gone", expired rows are only misses,
+// as telling them apart takes another query on every miss.
+//
+// They are emitted synchronously, like all Caddy events, so a handler that
+// writes the missing row has it found by the next request.
+
+// provisionEvents gets the events app, unless s isn't loaded in a config.
+func (s *SQLiteFS) provisionEvents(ctx caddy.Context) error {
+	if ctx.Context == nil {
+		return nil
+	}
+	app, err := ctx.App("events")
+	if err != nil {
+		return err
+	}
+	s.events, s.eventCtx = app.(*caddyevents.App), ctx
+	return nil
+}
+
+// emit emits the event sqlitefs.<event> with data and the db_path of s.
+func (s SQLiteFS) emit(event string, data map[string]any) {
+	if s.events == nil {
+		return
+	}
+	data["db_path"] = s.DBPath
+	s.events.Emit(s.eventCtx, "sqlitefs."+event, data)
+}
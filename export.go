@@ -0,0 +1,121 @@
+package sqlitefs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/dustin/go-humanize"
+)
+
+func cmdExport(fl caddycmd.Flags) (int, error) {
+	dbPath, dir := fl.Arg(0), fl.Arg(1)
+	root := strings.Trim(fl.String("prefix"), "/")
+	if root == "" {
+		root = "."
+	}
+	if !fs.ValidPath(root) {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid prefix %q", root)
+	}
+	if _, err := os.Stat(dbPath); err != nil {
+		// rather than creating an empty database
+		return caddy.ExitCodeFailedStartup, err
+	}
+	s, err := cliFS(dbPath, fl.String("dataset"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Cleanup()
+
+	var files int
+	var size int64
+	dirTimes := make(map[string]time.Time)
+	err = fs.WalkDir(s, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+		if root == "." {
+			rel = name
+		}
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		switch {
+		case d.IsDir():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			dirTimes[p] = info.ModTime()
+			return os.MkdirAll(p, 0o755)
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := s.ReadLink(name)
+			if err != nil {
+				return err
+			}
+			os.Remove(p)
+			return os.Symlink(filepath.FromSlash(target), p)
+		}
+		n, err := exportFile(s, name, p)
+		if err != nil {
+			return fmt.Errorf("exporting %s: %w", name, err)
+		}
+		files++
+		size += n
+		return nil
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	// after their files, which change them
+	for p, t := range dirTimes {
+		if !t.IsZero() {
+			os.Chtimes(p, t, t)
+		}
+	}
+	fmt.Printf("exported %d files (%s) to %s\n", files, humanize.IBytes(uint64(size)), dir)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// exportFile writes the file name to p with its mode and modification
+// time, returning its size.
+func exportFile(s *SQLiteFS, name, p string) (int64, error) {
+	f, err := s.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	mode := info.Mode().Perm()
+	if mode == 0 {
+		mode = 0o644
+	}
+	out, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, f)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		return 0, err
+	}
+	if t := info.ModTime(); !t.IsZero() {
+		if err := os.Chtimes(p, t, t); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
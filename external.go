@@ -0,0 +1,210 @@
+package sqlitefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// openExternal opens the content a row points to with its external column:
+// a local file path (optionally as a file:// URL) or an http(s) URL, which
+// must start with one of ExternalPrefixes. URLs are asked for their size
+// and modification time with a HEAD request on every open and Stat, as the
+// row doesn't keep them.
+func (s SQLiteFS) openExternal(ctx context.Context, location string) (io.ReadSeekCloser, int64, time.Time, error) {
+	isURL := isExternalURL(location)
+	var u *url.URL
+	if isURL {
+		var err error
+		if u, err = url.Parse(location); err != nil {
+			return nil, 0, time.Time{}, fmt.Errorf("external content %s: %w", location, err)
+		}
+		// fetched as checked, with no dot segments left for the server
+		// to resolve
+		u.Path, u.RawPath = path.Clean("/"+u.Path), ""
+		location = u.String()
+	} else {
+		location = filepath.Clean(strings.TrimPrefix(location, "file://"))
+	}
+	allowed := false
+	for _, prefix := range s.ExternalPrefixes {
+		if isURL && urlWithin(u, prefix) || !isURL && !isExternalURL(prefix) && pathWithin(location, prefix) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, 0, time.Time{}, fmt.Errorf("external content %s is outside external_prefixes: %w", location, fs.ErrPermission)
+	}
+
+	if isURL {
+		return s.openURL(ctx, location)
+	}
+	f, err := os.Open(location)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, time.Time{}, err
+	}
+	return f, info.Size(), info.ModTime(), nil
+}
+
+// isExternalURL reports whether location is an http(s) URL rather than a
+// local path.
+func isExternalURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// pathWithin reports whether the clean path name is the directory or file
+// prefix or below it, so /srv/media doesn't let through /srv/media-private.
+func pathWithin(name, prefix string) bool {
+	prefix = filepath.Clean(strings.TrimPrefix(prefix, "file://"))
+	return name == prefix || strings.HasPrefix(name, strings.TrimSuffix(prefix, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// urlWithin reports whether u has the scheme and host of the URL prefix
+// and a path within its path, compared apart so that neither
+// https://cdn.example.com.evil.net nor credentials before the host pass
+// for https://cdn.example.com.
+func urlWithin(u *url.URL, prefix string) bool {
+	p, err := url.Parse(prefix)
+	if err != nil || !isExternalURL(prefix) {
+		return false
+	}
+	if !strings.EqualFold(u.Scheme, p.Scheme) || !strings.EqualFold(u.Host, p.Host) || u.User != nil {
+		return false
+	}
+	dir := path.Clean("/" + p.Path)
+	return u.Path == dir || strings.HasPrefix(u.Path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// newExternalClient returns the client external content is fetched with,
+// which follows redirects only within ExternalPrefixes and waits at most
+// Timeout for each response to start.
+func (s SQLiteFS) newExternalClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Duration(s.Timeout)
+	prefixes := s.ExternalPrefixes
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			for _, prefix := range prefixes {
+				if urlWithin(req.URL, prefix) {
+					return nil
+				}
+			}
+			return fmt.Errorf("external content redirected to %s, outside external_prefixes: %w", req.URL, fs.ErrPermission)
+		},
+	}
+}
+
+func (s SQLiteFS) openURL(ctx context.Context, url string) (io.ReadSeekCloser, int64, time.Time, error) {
+	client := s.externalClient
+	if client == nil {
+		client = s.newExternalClient()
+	}
+	headCtx, cancel := s.queryContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(headCtx, http.MethodHead, url, nil)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, time.Time{}, fs.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return nil, 0, time.Time{}, fmt.Errorf("external content %s: HEAD answered %s without a length", url, resp.Status)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &rangeReader{ctx: ctx, client: client, url: url, size: resp.ContentLength}, resp.ContentLength, modTime, nil
+}
+
+// rangeReader streams a URL, turning seeks into range requests.
+type rangeReader struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	size   int64
+	off    int64
+	body   io.ReadCloser
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url, nil)
+		if err != nil {
+			return 0, err
+		}
+		if r.off > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.off))
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent:
+		case resp.StatusCode == http.StatusOK:
+			// no range support; skip to the offset
+			if _, err := io.CopyN(io.Discard, resp.Body, r.off); err != nil {
+				resp.Body.Close()
+				return 0, err
+			}
+		default:
+			resp.Body.Close()
+			return 0, fmt.Errorf("external content %s: GET answered %s", r.url, resp.Status)
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative offset %d", offset)
+	}
+	if offset != r.off && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *rangeReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
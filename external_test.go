@@ -0,0 +1,75 @@
+package sqlitefs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExternalPrefixes(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"assets/a.txt", "assets-private/b.txt"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("content"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "other")
+	}))
+	defer other.Close()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pub/away":
+			http.Redirect(w, r, other.URL+"/pub/a", http.StatusFound)
+		case "/pub/moved":
+			http.Redirect(w, r, srv.URL+"/pub/a", http.StatusFound)
+		case "/pub/out":
+			http.Redirect(w, r, srv.URL+"/private", http.StatusFound)
+		default:
+			io.WriteString(w, "content")
+		}
+	}))
+	defer srv.Close()
+
+	s := SQLiteFS{ExternalPrefixes: []string{filepath.Join(dir, "assets"), srv.URL + "/pub/"}}
+	for _, tc := range []struct {
+		location string
+		allowed  bool
+	}{
+		{filepath.Join(dir, "assets/a.txt"), true},
+		{"file://" + filepath.Join(dir, "assets/a.txt"), true},
+		{filepath.Join(dir, "assets-private/b.txt"), false},
+		{filepath.Join(dir, "assets/../assets-private/b.txt"), false},
+		{srv.URL + "/pub/a", true},
+		{srv.URL + "/pub/moved", true},
+		{srv.URL + "/pub/away", false},
+		{srv.URL + "/pub/out", false},
+		{srv.URL + "/pub/../private", false},
+		{srv.URL + "/pub/%2e%2e/private", false},
+		{srv.URL + "/public", false},
+		{"http://user@" + srv.Listener.Addr().String() + "/pub/a", false},
+		{other.URL + "/pub/a", false},
+	} {
+		rc, _, _, err := s.openExternal(context.Background(), tc.location)
+		if tc.allowed {
+			if err != nil {
+				t.Errorf("%s: %v", tc.location, err)
+				continue
+			}
+			if b, err := io.ReadAll(rc); err != nil || string(b) != "content" {
+				t.Errorf("%s: read %q, %v", tc.location, b, err)
+			}
+			rc.Close()
+		} else if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: got %v, want fs.ErrPermission", tc.location, err)
+		}
+	}
+}
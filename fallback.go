@@ -0,0 +1,83 @@
+package sqlitefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// A fallback file system serves the names the database has no row for,
+// so a few large or often changing files can stay on disk. Only the file
+// system of the config has one: names not found below mounts and in the
+// databases of a per-request db_path fall back to it by their full name.
+
+// provisionFallback loads the fallback file system of s, if any.
+func (s *SQLiteFS) provisionFallback(ctx caddy.Context) error {
+	switch {
+	case s.FallbackRaw != nil && s.FallbackRoot != "":
+		return errors.New("fallback and fallback_root are mutually exclusive")
+	case s.FallbackRaw != nil:
+		mod, err := ctx.LoadModule(s, "FallbackRaw")
+		if err != nil {
+			return fmt.Errorf("loading fallback file system: %v", err)
+		}
+		fsys, ok := mod.(fs.FS)
+		if !ok {
+			return fmt.Errorf("fallback module %T is not a file system", mod)
+		}
+		s.fallback = fsys
+	case s.FallbackRoot != "":
+		s.fallback = os.DirFS(s.FallbackRoot)
+	}
+	return nil
+}
+
+// primary returns s without its fallback, for serving a name from the
+// database first.
+func (s SQLiteFS) primary() SQLiteFS {
+	s.fallback = nil
+	return s
+}
+
+// fallsBack reports whether the name err was returned for is served by the
+// fallback: the database has no row for it, not even an expired one.
+func (s SQLiteFS) fallsBack(err error) bool {
+	return s.fallback != nil && errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrGone)
+}
+
+type contextOpener interface {
+	OpenContext(ctx context.Context, name string) (fs.File, error)
+}
+
+type contextStater interface {
+	StatContext(ctx context.Context, name string) (fs.FileInfo, error)
+}
+
+type contextDirReader interface {
+	ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error)
+}
+
+func (s SQLiteFS) fallbackOpen(ctx context.Context, name string) (fs.File, error) {
+	if o, ok := s.fallback.(contextOpener); ok {
+		return o.OpenContext(ctx, name)
+	}
+	return s.fallback.Open(name)
+}
+
+func (s SQLiteFS) fallbackStat(ctx context.Context, name string) (fs.FileInfo, error) {
+	if o, ok := s.fallback.(contextStater); ok {
+		return o.StatContext(ctx, name)
+	}
+	return fs.Stat(s.fallback, name)
+}
+
+func (s SQLiteFS) fallbackReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	if o, ok := s.fallback.(contextDirReader); ok {
+		return o.ReadDirContext(ctx, name)
+	}
+	return fs.ReadDir(s.fallback, name)
+}
@@ -0,0 +1,422 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(FileServer{})
+	httpcaddyfile.RegisterHandlerDirective("sqlite_file_server", parseFileServer)
+}
+
+// FileServer serves files from a sqlite file system with the request in
+// context, which the standard file_server can't provide. Features that
+// depend on the request, such as a placeholder tenant, need it.
+type FileServer struct {
+	// The sqlite file system to serve from.
+	FileSystemRaw json.RawMessage `json:"file_system,omitempty" caddy:"namespace=caddy.fs inline_key=backend"`
+
+	// Names of files to try for requests ending in a slash. Default: index.html.
+	IndexNames []string `json:"index_names,omitempty"`
+
+	// Redirect with 301 to the canonical name of files reached through an
+	// alias, a differently cased name or a canonical column.
+	RedirectCanonical bool `json:"redirect_canonical,omitempty"`
+
+	// Headers for files without rows in the headers table. The first
+	// matching entry applies.
+	DefaultHeaders []DefaultHeaders `json:"default_headers,omitempty"`
+
+	// After serving an HTML page, prefetch the assets it references in
+	// the background, so they are in cache when the browser asks.
+	PrefetchAssets bool `json:"prefetch_assets,omitempty"`
+
+	// Serve Markdown files rendered as HTML: page.md for requests for
+	// page.html that doesn't exist, and page.md itself when the request
+	// accepts text/html. Pages are cached in the rendered table if the
+	// database has one.
+	Markdown bool `json:"markdown,omitempty"`
+
+	// Serve the precompressed copy of a file, stored under its name with
+	// the suffix of the encoding (.br, .zst, .gz), in the first of these
+	// encodings that the request accepts: br, zstd or gzip.
+	Precompressed []string `json:"precompressed,omitempty"`
+
+	fsys *SQLiteFS
+}
+
+// CaddyModule returns the Caddy module information.
+func (FileServer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.sqlite_file_server",
+		New: func() caddy.Module { return new(FileServer) },
+	}
+}
+
+func (fsrv *FileServer) Provision(ctx caddy.Context) error {
+	fsys, err := loadFileSystem(ctx, fsrv, fsrv.FileSystemRaw)
+	if err != nil {
+		return err
+	}
+	fsrv.fsys = fsys
+	if len(fsrv.IndexNames) == 0 {
+		fsrv.IndexNames = []string{"index.html"}
+	}
+	return validatePrecompressed(fsrv.Precompressed)
+}
+
+func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Map(fsrv.placeholders(r))
+	}
+
+	var err error
+	for _, name := range requestNames(r, fsrv.IndexNames) {
+		var f fs.File
+		f, err = fsrv.fsys.OpenContext(r.Context(), name)
+		if err == nil {
+			defer f.Close()
+			if info, err := f.Stat(); err == nil && info.IsDir() {
+				if strings.HasSuffix(r.URL.Path, "/") {
+					// an index name that is a directory
+					return caddyhttp.Error(http.StatusNotFound, nil)
+				}
+				// like file_server, so relative links in its index resolve
+				target := r.URL.Path + "/"
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, http.StatusPermanentRedirect)
+				return nil
+			}
+			if fsrv.Markdown && isMarkdown(name) {
+				w.Header().Add("Vary", "Accept")
+				if acceptsHTML(r) {
+					return fsrv.serveMarkdown(w, r, f)
+				}
+			}
+			return fsrv.serveFile(w, r, f)
+		}
+		if fsrv.Markdown && isHTML(name) && errors.Is(err, fs.ErrNotExist) {
+			var md fs.File
+			if md, err = fsrv.fsys.OpenContext(r.Context(), markdownSource(name)); err == nil {
+				defer md.Close()
+				return fsrv.serveMarkdown(w, r, md)
+			}
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	return fsErrorStatus(err)
+}
+
+// loadFileSystem loads the sqlite file system a handler is configured with
+// in its FileSystemRaw field.
+func loadFileSystem(ctx caddy.Context, handler any, raw json.RawMessage) (*SQLiteFS, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("file_system is required")
+	}
+	mod, err := ctx.LoadModule(handler, "FileSystemRaw")
+	if err != nil {
+		return nil, fmt.Errorf("loading file system module: %v", err)
+	}
+	fsys, ok := mod.(*SQLiteFS)
+	if !ok {
+		return nil, fmt.Errorf("file system module %T is not caddy.fs.sqlite", mod)
+	}
+	return fsys, nil
+}
+
+// requestNames returns the file names to try for r, in order.
+func requestNames(r *http.Request, indexNames []string) []string {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		return []string{name}
+	}
+	var names []string
+	for _, index := range indexNames {
+		names = append(names, strings.TrimPrefix(path.Join(name, index), "/"))
+	}
+	return names
+}
+
+func (fsrv *FileServer) serveFile(w http.ResponseWriter, r *http.Request, f fs.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("%s is not seekable", info.Name()))
+	}
+	if fi, ok := info.(sqliteFileInfo); ok {
+		if fsrv.RedirectCanonical && fi.canonical != "" {
+			target := "/" + strings.TrimPrefix(fi.canonical, "/")
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return nil
+		}
+		if fi.stale {
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+		}
+		headers, err := fsrv.fsys.fileHeaders(r.Context(), fi.name)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		if fi.contentType != "" {
+			// unless the headers table sets another
+			w.Header().Set("Content-Type", fi.contentType)
+		}
+		if headers == nil {
+			for _, dh := range fsrv.DefaultHeaders {
+				if dh.matches(fi.name, fi.contentType) {
+					headers = dh.Headers
+					break
+				}
+			}
+		}
+		for field, values := range headers {
+			w.Header()[http.CanonicalHeaderKey(field)] = append([]string(nil), values...)
+		}
+		if contentType, ok := imageTypes[fi.variant]; ok {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if isImage(fi.name) && strings.Contains(fsrv.fsys.Variant, "http.sqlitefs.image_formats") {
+			w.Header().Add("Vary", "Accept")
+		}
+		etag := fi.etag()
+		var encoding string // of rs, if not the file itself
+		if len(fsrv.Precompressed) > 0 || fi.compression != "" {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		if len(fsrv.Precompressed) > 0 {
+			if enc, cf, cinfo := fsrv.openPrecompressed(r, fi.name); cf != nil {
+				defer cf.Close()
+				if crs, ok := cf.(io.ReadSeeker); ok {
+					rs, encoding = crs, enc
+					if cfi, ok := cinfo.(sqliteFileInfo); ok {
+						// another representation, another tag
+						etag = cfi.etag()
+					}
+				}
+			}
+		}
+		if sf, ok := f.(*sqliteFile); ok && encoding == "" && sf.compressed != nil &&
+			slices.Contains(encode.AcceptedEncodings(r, nil), fi.compression) {
+			// sent as it is stored
+			rs, encoding = bytes.NewReader(sf.compressed), fi.compression
+			etag = fi.encodedETag(encoding)
+		}
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+			if w.Header().Get("Content-Type") == "" {
+				// not sniffed from the compressed bytes
+				w.Header()["Content-Type"] = nil
+				if contentType := mime.TypeByExtension(path.Ext(fi.name)); contentType != "" {
+					w.Header().Set("Content-Type", contentType)
+				}
+			}
+		}
+		if set := w.Header().Get("Etag"); etag != "" && (set == "" || set == fi.etag()) {
+			// checked against conditional requests by ServeContent, over
+			// the tag of the uncompressed file sqlite_etag sets
+			w.Header().Set("Etag", etag)
+		}
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), rs)
+	if fi, ok := info.(sqliteFileInfo); ok && fsrv.PrefetchAssets && r.Method == http.MethodGet && isHTML(fi.name) {
+		ctx := context.WithoutCancel(r.Context())
+		go func() {
+			if err := fsrv.fsys.Prefetch(ctx, fi.name); err != nil {
+				fsrv.fsys.logger.Debug("prefetching assets", zap.String("name", fi.name), zap.Error(err))
+			}
+		}()
+	}
+	return nil
+}
+
+// placeholders provides {http.sqlitefs.integrity.<name>}, the Subresource
+// Integrity hash of a file, for templates rendering pages served here, and
+// {http.sqlitefs.image_formats}, the image renditions the request accepts.
+func (fsrv *FileServer) placeholders(r *http.Request) caddy.ReplacerFunc {
+	ctx := r.Context()
+	return func(key string) (any, bool) {
+		if key == "http.sqlitefs.image_formats" {
+			return acceptedImageFormats(r), true
+		}
+		name, ok := strings.CutPrefix(key, "http.sqlitefs.integrity.")
+		if !ok {
+			return nil, false
+		}
+		integrity, err := fsrv.fsys.Integrity(ctx, strings.TrimPrefix(name, "/"))
+		if err != nil {
+			fsrv.fsys.logger.Debug("integrity placeholder", zap.String("name", name), zap.Error(err))
+			return nil, false
+		}
+		return integrity, true
+	}
+}
+
+func isHTML(name string) bool {
+	ext := path.Ext(name)
+	return ext == ".html" || ext == ".htm"
+}
+
+// fsErrorStatus maps a file system error to an HTTP error.
+func fsErrorStatus(err error) error {
+	switch {
+	case errors.Is(err, ErrGone):
+		return caddyhttp.Error(http.StatusGone, err)
+	case errors.Is(err, ErrTooManyRequests):
+		return caddyhttp.Error(http.StatusTooManyRequests, err)
+	case errors.Is(err, fs.ErrNotExist):
+		return caddyhttp.Error(http.StatusNotFound, err)
+	case errors.Is(err, fs.ErrPermission):
+		return caddyhttp.Error(http.StatusForbidden, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	default:
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+}
+
+// parseFileServer sets up the handler from Caddyfile tokens. Syntax:
+//
+//	sqlite_file_server [<matcher>] [<db_path>] {
+//		fs    sqlite <db_path>
+//		index <filenames...>
+//		redirect_canonical
+//		default_header <match> <field> <value>
+//		prefetch_assets
+//		markdown
+//		precompressed [<encodings...>]
+//	}
+func parseFileServer(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	fsrv := new(FileServer)
+	err := fsrv.UnmarshalCaddyfile(h.Dispenser)
+	return fsrv, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (fsrv *FileServer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			fsrv.FileSystemRaw = caddyconfig.JSONModuleObject(&SQLiteFS{DBPath: adaptDBPath(d, d.Val())}, "backend", "sqlite", nil)
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "fs":
+				if err := unmarshalFileSystem(d, &fsrv.FileSystemRaw); err != nil {
+					return err
+				}
+			case "index":
+				fsrv.IndexNames = d.RemainingArgs()
+				if len(fsrv.IndexNames) == 0 {
+					return d.ArgErr()
+				}
+			case "redirect_canonical":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				fsrv.RedirectCanonical = true
+			case "prefetch_assets":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				fsrv.PrefetchAssets = true
+			case "markdown":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				fsrv.Markdown = true
+			case "precompressed":
+				fsrv.Precompressed = d.RemainingArgs()
+				if len(fsrv.Precompressed) == 0 {
+					fsrv.Precompressed = defaultPrecompressed
+				}
+			case "default_header":
+				var match, field, value string
+				if !d.AllArgs(&match, &field, &value) {
+					return d.ArgErr()
+				}
+				fsrv.addDefaultHeader(match, field, value)
+			default:
+				return d.Errf("unrecognized parameter '%s'", d.Val())
+			}
+		}
+	}
+	if fsrv.FileSystemRaw == nil {
+		return d.Err("missing file system")
+	}
+	return nil
+}
+
+// unmarshalFileSystem parses the arguments and block of an fs subdirective
+// into raw.
+func unmarshalFileSystem(d *caddyfile.Dispenser, raw *json.RawMessage) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	if *raw != nil {
+		return d.Err("file system already specified")
+	}
+	if d.Val() != "sqlite" {
+		return d.Errf("file system must be sqlite, got '%s'", d.Val())
+	}
+	unm, err := caddyfile.UnmarshalModule(d, "caddy.fs.sqlite")
+	if err != nil {
+		return err
+	}
+	*raw = caddyconfig.JSONModuleObject(unm, "backend", "sqlite", nil)
+	return nil
+}
+
+// addDefaultHeader adds field to the default headers for match, keeping
+// entries in the order their first header appeared.
+func (fsrv *FileServer) addDefaultHeader(match, field, value string) {
+	for i := range fsrv.DefaultHeaders {
+		if fsrv.DefaultHeaders[i].Match == match {
+			fsrv.DefaultHeaders[i].Headers.Add(field, value)
+			return
+		}
+	}
+	fsrv.DefaultHeaders = append(fsrv.DefaultHeaders, DefaultHeaders{Match: match, Headers: http.Header{}})
+	fsrv.DefaultHeaders[len(fsrv.DefaultHeaders)-1].Headers.Add(field, value)
+}
+
+// Interface guards
+var (
+	_ caddyhttp.MiddlewareHandler = (*FileServer)(nil)
+	_ caddy.Provisioner           = (*FileServer)(nil)
+	_ caddyfile.Unmarshaler       = (*FileServer)(nil)
+)
@@ -0,0 +1,272 @@
+package sqlitefs
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// replacer returns the request's replacer when ctx belongs to an HTTP
+// request, or one that only knows global placeholders such as {env.*}.
+func replacer(ctx context.Context) *caddy.Replacer {
+	if repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		return repl
+	}
+	return caddy.NewReplacer()
+}
+
+// tenantKey is the context key of a tenant chosen by the caller.
+type tenantKey struct{}
+
+// WithTenant returns a context for reading and writing the files of tenant,
+// for callers without a request to resolve the tenant placeholder from,
+// such as the admin API.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenant returns the tenant of ctx.
+func (s SQLiteFS) tenant(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+		return tenant
+	}
+	return replacer(ctx).ReplaceAll(s.Tenant, "")
+}
+
+// rowFilter returns the conditions, beyond the name, that a row of the
+// files table must meet to be visible for ctx.
+func (s SQLiteFS) rowFilter(ctx context.Context) (string, []any, bool) {
+	scope, args, ok := s.scopeFilter(ctx)
+	if !ok {
+		return "", nil, false
+	}
+	if s.columns["max_downloads"] {
+		// used up rows behave as expired
+		scope = "(max_downloads IS NULL OR max_downloads > 0) AND " + scope
+	}
+	if s.Expired == "stale" {
+		return "(expired_at IS NULL OR expired_at > strftime('%s','now') - ?) AND " + scope,
+			append([]any{int64(time.Duration(s.StaleGrace).Seconds())}, args...), true
+	}
+	return "(expired_at IS NULL OR expired_at > strftime('%s','now')) AND " + scope, args, true
+}
+
+// scopeFilter returns the conditions other than expiry, which select the
+// rows that exist at all for ctx.
+func (s SQLiteFS) scopeFilter(ctx context.Context) (string, []any, bool) {
+	return s.scopeFilterExcept(ctx, "")
+}
+
+// scopeFilterExcept is scopeFilter without the "tenant" or "published"
+// conditions, for telling why a row is hidden.
+func (s SQLiteFS) scopeFilterExcept(ctx context.Context, except string) (string, []any, bool) {
+	var conds []string
+	var args []any
+
+	if s.TenantColumn != "" && except != "tenant" {
+		tenant := s.tenant(ctx)
+		if tenant == "" {
+			// never fall back to rows of other tenants
+			return "", nil, false
+		}
+		conds = append(conds, quoteIdent(s.TenantColumn)+"=?")
+		args = append(args, tenant)
+	}
+
+	if s.columns["dataset"] {
+		if label := s.activeDataset(); label != "" {
+			conds = append(conds, "dataset=?")
+			args = append(args, label)
+		} else {
+			conds = append(conds, "dataset IS NULL")
+		}
+	}
+	if s.columns["variant"] {
+		switch variants := s.variants(ctx); len(variants) {
+		case 0:
+			conds = append(conds, "variant IS NULL")
+		case 1:
+			conds = append(conds, "(variant IS NULL OR variant=?)")
+			args = append(args, variants[0])
+		default:
+			conds = append(conds, "(variant IS NULL OR variant IN ("+strings.TrimSuffix(strings.Repeat("?,", len(variants)), ",")+"))")
+			for _, v := range variants {
+				args = append(args, v)
+			}
+		}
+	}
+	if s.columns["version"] {
+		repl := replacer(ctx)
+		if v := repl.ReplaceAll(s.Version, ""); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return "", nil, false
+			}
+			conds = append(conds, "version=?")
+			args = append(args, n)
+		} else if g := repl.ReplaceAll(s.Generation, ""); g != "" {
+			n, err := strconv.ParseInt(g, 10, 64)
+			if err != nil {
+				return "", nil, false
+			}
+			conds = append(conds, "version<=?")
+			args = append(args, n)
+		}
+	}
+	if s.columns["deleted_at"] {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+
+	if except != "published" && !s.previewing(ctx) {
+		if s.RequirePublished {
+			conds = append(conds, "published")
+		}
+		if s.columns["publish_at"] {
+			conds = append(conds, "(publish_at IS NULL OR publish_at <= strftime('%s','now'))")
+		}
+	}
+
+	if len(conds) == 0 {
+		return "1", nil, true
+	}
+	return strings.Join(conds, " AND "), args, true
+}
+
+// expiredExists reports whether name has a row that is hidden only
+// because it expired or ran out of downloads.
+func (s SQLiteFS) expiredExists(ctx context.Context, name string) bool {
+	scope, args, ok := s.scopeFilter(ctx)
+	if !ok {
+		return false
+	}
+	expired := "expired_at <= strftime('%s','now')"
+	if s.columns["max_downloads"] {
+		expired = "(" + expired + " OR max_downloads <= 0)"
+	}
+	var one int
+	err := s.db.QueryRowContext(ctx, "SELECT 1 FROM files WHERE name=? AND "+expired+" AND "+scope+" LIMIT 1", append([]any{name}, args...)...).Scan(&one)
+	return err == nil
+}
+
+// previewing reports whether the lookup carries the preview token.
+func (s SQLiteFS) previewing(ctx context.Context) bool {
+	if s.Preview == "" || s.PreviewToken == "" {
+		return false
+	}
+	repl := replacer(ctx)
+	token := repl.ReplaceAll(s.PreviewToken, "")
+	got := repl.ReplaceAll(s.Preview, "")
+	return token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// activeDataset returns the dataset label currently served.
+func (s SQLiteFS) activeDataset() string {
+	if s.dataset == nil {
+		return s.Dataset
+	}
+	return s.dataset.Load().(string)
+}
+
+// rowKey tells apart the rows sharing a name.
+type rowKey struct {
+	version *int64
+	variant *string
+
+	variantColumn bool // so the fallback row can be told apart from variants
+}
+
+// where returns the condition matching the row of name with this key.
+func (k rowKey) where(name string) (string, []any) {
+	where, args := "name=?", []any{name}
+	if k.version != nil {
+		where, args = where+" AND version=?", append(args, *k.version)
+	}
+	if k.variant != nil {
+		where, args = where+" AND variant=?", append(args, *k.variant)
+	} else if k.variantColumn {
+		where += " AND variant IS NULL"
+	}
+	return where, args
+}
+
+// variants returns the variants to serve for ctx, most preferred first.
+func (s SQLiteFS) variants(ctx context.Context) []string {
+	var variants []string
+	for _, v := range strings.Split(replacer(ctx).ReplaceAll(s.Variant, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			variants = append(variants, v)
+		}
+	}
+	return variants
+}
+
+// latestFirst orders the candidate rows of a name so the one to serve
+// comes first: a matching variant before the fallback, the preferred of
+// several, then the newest.
+func (s SQLiteFS) latestFirst(ctx context.Context) (string, []any) {
+	var order []string
+	var args []any
+	if s.columns["variant"] {
+		order = append(order, "variant IS NULL")
+		if variants := s.variants(ctx); len(variants) > 1 {
+			order = append(order, "instr(?, ','||variant||',')")
+			args = append(args, ","+strings.Join(variants, ",")+",")
+		}
+	}
+	if s.columns["version"] {
+		order = append(order, "version DESC")
+	}
+	if len(order) == 0 {
+		return "", nil
+	}
+	return " ORDER BY " + strings.Join(order, ", "), args
+}
+
+// loadContent fetches the content of the row of name with key, as long as
+// it is still in scope for ctx.
+func (s SQLiteFS) loadContent(ctx context.Context, name string, key rowKey) ([]byte, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+	scope, args, ok := s.scopeFilter(ctx)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	where, keyArgs := key.where(name)
+	var content []byte
+	start := time.Now()
+	err := s.db.QueryRowContext(ctx, "SELECT content FROM files WHERE "+where+" AND "+scope+" LIMIT 1", append(keyArgs, args...)...).Scan(&content)
+	s.metrics.queried("content", start)
+	if errors.Is(err, sql.ErrNoRows) {
+		// removed since it was opened
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, s.dbError("read", name, err)
+	}
+	if content == nil {
+		content = []byte{}
+	}
+	s.metrics.read(len(content))
+	return content, nil
+}
+
+// claimDownload takes one of the remaining downloads of name, failing with
+// fs.ErrNotExist once they are used up. Unlimited rows stay NULL.
+func (s SQLiteFS) claimDownload(ctx context.Context, name string, key rowKey, filter string, args []any) error {
+	where, keyArgs := key.where(name)
+	res, err := s.db.ExecContext(ctx, "UPDATE files SET max_downloads=max_downloads-1 WHERE "+where+" AND "+filter, append(keyArgs, args...)...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fs.ErrNotExist
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package sqlitefs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestRowFilter(t *testing.T) {
+	future, past := time.Now().Add(time.Hour).Unix(), time.Now().Add(-time.Hour).Unix()
+	for _, tc := range []struct {
+		name    string
+		fs      SQLiteFS
+		row     map[string]any // columns other than those of every row
+		tenant  string
+		visible bool
+	}{
+		{"own tenant", SQLiteFS{}, nil, "a", true},
+		{"other tenant", SQLiteFS{}, map[string]any{"site": "b"}, "a", false},
+		{"no tenant", SQLiteFS{}, nil, "", false},
+
+		{"active dataset", SQLiteFS{Dataset: "blue"}, map[string]any{"dataset": "blue"}, "a", true},
+		{"inactive dataset", SQLiteFS{Dataset: "blue"}, map[string]any{"dataset": "green"}, "a", false},
+		{"no dataset while one is active", SQLiteFS{Dataset: "blue"}, nil, "a", false},
+		{"dataset while none is active", SQLiteFS{}, map[string]any{"dataset": "blue"}, "a", false},
+
+		{"requested variant", SQLiteFS{Variant: "webp"}, map[string]any{"variant": "webp"}, "a", true},
+		{"fallback of a variant", SQLiteFS{Variant: "webp"}, nil, "a", true},
+		{"other variant", SQLiteFS{Variant: "webp"}, map[string]any{"variant": "avif"}, "a", false},
+		{"one of several variants", SQLiteFS{Variant: "avif, webp"}, map[string]any{"variant": "webp"}, "a", true},
+		{"variant when none is requested", SQLiteFS{}, map[string]any{"variant": "webp"}, "a", false},
+
+		{"requested version", SQLiteFS{Version: "2"}, map[string]any{"version": 2}, "a", true},
+		{"other version", SQLiteFS{Version: "2"}, map[string]any{"version": 1}, "a", false},
+		{"version of the generation", SQLiteFS{Generation: "2"}, map[string]any{"version": 1}, "a", true},
+		{"version after the generation", SQLiteFS{Generation: "2"}, map[string]any{"version": 3}, "a", false},
+		{"any version", SQLiteFS{}, map[string]any{"version": 7}, "a", true},
+
+		{"soft deleted", SQLiteFS{}, map[string]any{"deleted_at": past}, "a", false},
+
+		{"published", SQLiteFS{}, map[string]any{"publish_at": past}, "a", true},
+		{"scheduled", SQLiteFS{}, map[string]any{"publish_at": future}, "a", false},
+		{"scheduled, previewed", SQLiteFS{Preview: "token", PreviewToken: "token"}, map[string]any{"publish_at": future}, "a", true},
+		{"draft", SQLiteFS{RequirePublished: true}, map[string]any{"published": 0}, "a", false},
+		{"draft, previewed", SQLiteFS{RequirePublished: true, Preview: "token", PreviewToken: "token"}, map[string]any{"published": 0}, "a", true},
+		{"not a draft", SQLiteFS{RequirePublished: true}, map[string]any{"published": 1}, "a", true},
+
+		{"expired", SQLiteFS{}, map[string]any{"expired_at": past}, "a", false},
+		{"expired within stale_grace", SQLiteFS{Expired: "stale", StaleGrace: caddy.Duration(2 * time.Hour)}, map[string]any{"expired_at": past}, "a", true},
+		{"downloads used up", SQLiteFS{}, map[string]any{"max_downloads": 0}, "a", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fs.TenantColumn = "site"
+			cols, vals := []string{"name", "content", "modified", "mode", "site"}, []any{"f.txt", "x", 1, 420, "a"}
+			for col, v := range tc.row {
+				if col == "site" {
+					vals[4] = v
+					continue
+				}
+				cols, vals = append(cols, col), append(vals, v)
+			}
+			s := newTestFS(t, tc.fs,
+				"ALTER TABLE files ADD COLUMN site TEXT",
+				"ALTER TABLE files ADD COLUMN dataset TEXT",
+				"ALTER TABLE files ADD COLUMN variant TEXT",
+				"ALTER TABLE files ADD COLUMN version INTEGER")
+			mustExec(t, s, "INSERT INTO files ("+strings.Join(cols, ", ")+") VALUES (?"+strings.Repeat(", ?", len(vals)-1)+")", vals...)
+
+			ctx := context.Background()
+			if tc.tenant != "" {
+				ctx = WithTenant(ctx, tc.tenant)
+			}
+			f, err := s.OpenContext(ctx, "f.txt")
+			if err == nil {
+				f.Close()
+			}
+			switch {
+			case tc.visible && err != nil:
+				t.Fatalf("got %v, want the row", err)
+			case !tc.visible && !errors.Is(err, fs.ErrNotExist):
+				t.Fatalf("got %v, want fs.ErrNotExist", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// fingerprintedName returns name with a short hash of content before its
+// extension, such as css/site.1a2b3c4d.css for css/site.css, so it can be
+// served as immutable.
+func fingerprintedName(name string, content []byte) string {
+	sum := sha256.Sum256(content)
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:4]) + ext
+}
+
+// rewriteAssets points the references of the HTML or CSS file name to files
+// in manifest, which maps names to their fingerprinted names, at the
+// fingerprinted files. Other content is returned as is.
+func rewriteAssets(name string, content []byte, manifest map[string]string) []byte {
+	if len(manifest) == 0 {
+		return content
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".html", ".htm":
+		return rewriteHTML(name, content, manifest)
+	case ".css":
+		return rewriteCSS(name, content, manifest)
+	}
+	return content
+}
+
+// rewriteRef returns ref in the file name pointed at its fingerprinted
+// file, keeping it relative or absolute and keeping any query or fragment.
+func rewriteRef(name, ref string, manifest map[string]string) (string, bool) {
+	asset, ok := localAsset(name, ref)
+	if !ok {
+		return "", false
+	}
+	hashed, ok := manifest[asset]
+	if !ok {
+		return "", false
+	}
+	var suffix string
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		ref, suffix = ref[:i], ref[i:]
+	}
+	// fingerprinting keeps the directory, so only the last element changes
+	dir := ref[:strings.LastIndex(ref, "/")+1]
+	return dir + path.Base(hashed) + suffix, true
+}
+
+func rewriteHTML(name string, page []byte, manifest map[string]string) []byte {
+	var out bytes.Buffer
+	z := html.NewTokenizer(bytes.NewReader(page))
+	inStyle := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			out.Write(z.Raw())
+			break
+		}
+		// Raw is only valid until the next call that reads
+		raw := string(z.Raw())
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tag, hasAttr := z.TagName()
+			inStyle = tt == html.StartTagToken && string(tag) == "style"
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				var rewritten string
+				switch string(key) {
+				case "src", "href", "poster":
+					rewritten, _ = rewriteRef(name, string(val), manifest)
+				case "srcset":
+					rewritten = rewriteSrcset(name, string(val), manifest)
+				case "style":
+					rewritten = string(rewriteCSS(name, val, manifest))
+				}
+				if rewritten != "" && rewritten != string(val) {
+					raw = replaceAttrValue(raw, string(key), string(val), rewritten)
+				}
+			}
+		case html.TextToken:
+			if inStyle {
+				raw = string(rewriteCSS(name, []byte(raw), manifest))
+			}
+		default:
+			inStyle = false
+		}
+		out.WriteString(raw)
+	}
+	return out.Bytes()
+}
+
+// rewriteSrcset rewrites the candidates of a srcset attribute, such as
+// "a.png 1x, a@2x.png 2x".
+func rewriteSrcset(name, srcset string, manifest map[string]string) string {
+	candidates := strings.Split(srcset, ",")
+	for i, c := range candidates {
+		fields := strings.Fields(c)
+		if len(fields) == 0 {
+			continue
+		}
+		if ref, ok := rewriteRef(name, fields[0], manifest); ok {
+			candidates[i] = strings.Replace(c, fields[0], ref, 1)
+		}
+	}
+	return strings.Join(candidates, ",")
+}
+
+// replaceAttrValue replaces the value val of the attribute key in the raw
+// tag. Values written with character references aren't matched and stay as
+// they are.
+func replaceAttrValue(raw, key, val, rewritten string) string {
+	re := regexp.MustCompile(`(?i)(\s` + regexp.QuoteMeta(key) + `\s*=\s*["']?)` + regexp.QuoteMeta(val) + `(["'\s/>]|$)`)
+	m := re.FindStringSubmatchIndex(raw)
+	if m == nil {
+		return raw
+	}
+	return raw[:m[3]] + rewritten + raw[m[4]:]
+}
+
+var cssRefs = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^'")\s]*))\s*\)|@import\s+(?:"([^"]*)"|'([^']*)')`)
+
+// rewriteCSS rewrites the url() and @import references of a stylesheet.
+func rewriteCSS(name string, css []byte, manifest map[string]string) []byte {
+	var out bytes.Buffer
+	last := 0
+	for _, m := range cssRefs.FindAllSubmatchIndex(css, -1) {
+		// one of the groups after the whole match holds the reference
+		for g := 2; g < len(m); g += 2 {
+			start, end := m[g], m[g+1]
+			if start < 0 {
+				continue
+			}
+			if ref, ok := rewriteRef(name, string(css[start:end]), manifest); ok {
+				out.Write(css[last:start])
+				out.WriteString(ref)
+				last = end
+			}
+			break
+		}
+	}
+	if last == 0 {
+		return css
+	}
+	out.Write(css[last:])
+	return out.Bytes()
+}
@@ -0,0 +1,235 @@
+package sqlitefs
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Glob implements fs.GlobFS.
+func (s SQLiteFS) Glob(pattern string) ([]string, error) {
+	return s.GlobContext(context.Background(), pattern)
+}
+
+// GlobContext returns the names that pattern, in the syntax of path.Match,
+// matches for the request ctx belongs to, sorted and at most
+// MaxListEntries of them. The rows are found with a GLOB query, which the
+// primary key index serves up to the first wildcard, and directories are
+// matched whether they have rows or are implied by the files below them.
+func (s SQLiteFS) GlobContext(ctx context.Context, pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if !hasMeta(pattern) {
+		// as in fs.Glob, there is nothing to match, only a name to find
+		if _, err := s.StatContext(ctx, pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+	if s.fallback != nil {
+		matches, err := s.primary().GlobContext(ctx, pattern)
+		if err != nil {
+			return nil, err
+		}
+		more, err := fs.Glob(s.fallback, pattern)
+		if err != nil {
+			return nil, err
+		}
+		return s.sortMatches(append(matches, more...)), nil
+	}
+
+	var matches []string
+	var err error
+	if s.pool != nil {
+		fsys, perr := s.pool.get(ctx)
+		if perr != nil {
+			return nil, perr
+		}
+		matches, err = fsys.GlobContext(ctx, pattern)
+	} else {
+		matches, err = s.glob(ctx, pattern)
+	}
+	if err != nil || len(s.mounts) == 0 {
+		return matches, err
+	}
+	// names below a mount are served by the longest one, and never come
+	// from this database
+	own := matches[:0]
+	for _, name := range matches {
+		if m, rest := s.mounted(name); m == nil || rest == "." {
+			own = append(own, name)
+		}
+	}
+	for i := range s.mounts {
+		m := &s.mounts[i]
+		if name, ok := globName(pattern, m.prefix); ok && s.nameAllowed(name) {
+			// listed as a directory
+			own = append(own, name)
+		}
+		more, err := m.glob(ctx, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range more {
+			if mm, _ := s.mounted(name); mm == m {
+				own = append(own, name)
+			}
+		}
+	}
+	return s.sortMatches(own), nil
+}
+
+// globName returns the name at the depth of pattern that full is, or is
+// below as a directory, and whether pattern matches it.
+func globName(pattern, full string) (string, bool) {
+	depth := strings.Count(pattern, "/") + 1
+	elems := strings.SplitN(full, "/", depth+1)
+	if len(elems) < depth {
+		return "", false
+	}
+	name := strings.Join(elems[:depth], "/")
+	ok, _ := path.Match(pattern, name)
+	return name, ok
+}
+
+// glob returns the names in VirtualFiles and the rows that pattern
+// matches.
+func (s SQLiteFS) glob(ctx context.Context, pattern string) ([]string, error) {
+	release, err := s.startExpensive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	seen := make(map[string]bool)
+	var matches []string
+	add := func(full string) bool {
+		name, ok := globName(pattern, full)
+		if !ok || seen[name] || !s.nameAllowed(name) {
+			return true
+		}
+		if s.MaxListEntries > 0 && len(matches) >= s.MaxListEntries {
+			return false
+		}
+		seen[name] = true
+		matches = append(matches, name)
+		return true
+	}
+
+	for full := range s.VirtualFiles {
+		add(full)
+	}
+	if err := s.usable(); err != nil {
+		return nil, err
+	}
+	// the directories before the first wildcard are a range of names
+	var prefix string
+	for _, elem := range strings.Split(pattern, "/") {
+		if hasMeta(elem) {
+			break
+		}
+		prefix += elem + "/"
+	}
+	glob := globPattern(pattern)
+	if s.root != "" {
+		prefix, glob = s.root+"/"+prefix, globLiteral(s.root)+"/"+glob
+	}
+	err = s.readDirRows(ctx, prefix, glob, func(full string, _ sqliteFileInfo) bool {
+		return add(s.servedName(full))
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// glob returns the names below m that pattern matches, by the names they
+// have in the file system m is mounted in.
+func (m *mount) glob(ctx context.Context, pattern string) ([]string, error) {
+	n := strings.Count(m.prefix, "/") + 1
+	elems := strings.SplitN(pattern, "/", n+1)
+	if len(elems) <= n {
+		// matches the prefix at most, which is listed as a directory
+		return nil, nil
+	}
+	if ok, _ := path.Match(strings.Join(elems[:n], "/"), m.prefix); !ok {
+		return nil, nil
+	}
+	matches, err := m.fsys.GlobContext(ctx, elems[n])
+	for i := range matches {
+		matches[i] = m.prefix + "/" + matches[i]
+	}
+	return matches, err
+}
+
+// sortMatches sorts names and drops the repeated ones and those beyond
+// MaxListEntries.
+func (s SQLiteFS) sortMatches(names []string) []string {
+	sort.Strings(names)
+	out := names[:0]
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		if s.MaxListEntries > 0 && len(out) >= s.MaxListEntries {
+			break
+		}
+		out = append(out, name)
+	}
+	return out
+}
+
+// hasMeta reports whether pattern has any of the special characters of
+// path.Match.
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// globPattern translates a path.Match pattern into one for sqlite's GLOB
+// that matches at least the same names. GLOB's * also matches slashes and
+// its character classes differ, so each class becomes a ?, and the names
+// found are matched against the pattern itself.
+func globPattern(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*', '?':
+			b.WriteByte(c)
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(globLiteral(pattern[i : i+1]))
+			}
+		case '[':
+			// to the ] ending the class, which path.Match checked is there
+			for i++; pattern[i] != ']'; i++ {
+				if pattern[i] == '\\' {
+					i++
+				}
+			}
+			b.WriteByte('?')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// globLiteral returns s as a GLOB pattern matching only itself.
+func globLiteral(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c == '*' || c == '?' || c == '[' {
+			b.WriteByte('[')
+			b.WriteRune(c)
+			b.WriteByte(']')
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
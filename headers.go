@@ -0,0 +1,75 @@
+package sqlitefs
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// fileHeaders returns the response headers stored for name in the headers
+// table, if it exists.
+func (s SQLiteFS) fileHeaders(ctx context.Context, name string) (http.Header, error) {
+	if m, rest := s.mounted(name); m != nil {
+		return m.fsys.fileHeaders(ctx, rest)
+	}
+	if s.pool != nil {
+		fsys, err := s.pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return fsys.fileHeaders(ctx, name)
+	}
+	if !s.headers {
+		return nil, nil
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT header, value FROM headers WHERE name=?", s.rootName(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var h http.Header
+	for rows.Next() {
+		var field, value string
+		if err := rows.Scan(&field, &value); err != nil {
+			return nil, err
+		}
+		if h == nil {
+			h = make(http.Header)
+		}
+		h.Add(field, value)
+	}
+	return h, rows.Err()
+}
+
+// DefaultHeaders are response headers for files without rows in the
+// headers table, chosen by path or content type.
+type DefaultHeaders struct {
+	// A path.Match pattern: one starting with a slash matches the request
+	// path, others the content type of the file, stored or guessed from
+	// the extension, such as image/* or text/html.
+	Match string `json:"match,omitempty"`
+
+	Headers http.Header `json:"headers,omitempty"`
+}
+
+// matches reports whether the defaults apply to the file name, whose
+// stored content type is contentType if it has one.
+func (dh DefaultHeaders) matches(name, contentType string) bool {
+	if strings.HasPrefix(dh.Match, "/") {
+		ok, _ := path.Match(dh.Match, "/"+name)
+		return ok
+	}
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(name))
+	}
+	ctype, _, _ := strings.Cut(contentType, ";")
+	ctype = strings.TrimSpace(ctype)
+	if ctype == "" {
+		return false
+	}
+	ok, _ := path.Match(dh.Match, ctype)
+	return ok
+}
@@ -0,0 +1,43 @@
+package sqlitefs
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const hitsSchema = `
+CREATE TABLE IF NOT EXISTS "hits" (
+	"name" TEXT,
+	"hour" INTEGER, -- unix timestamp of the start of the hour
+	"count" INTEGER,
+	PRIMARY KEY ("name", "hour")
+) WITHOUT ROWID;
+`
+
+// startHits begins counting opened files into the hits table.
+func (s *SQLiteFS) startHits(db *sql.DB, logger *zap.Logger) error {
+	if _, err := db.Exec(hitsSchema); err != nil {
+		return fmt.Errorf("creating hits table: %w", err)
+	}
+	s.hits = newBatcher(time.Duration(s.FlushInterval),
+		func(old, v int64) int64 { return old + v },
+		func(pending map[string]int64) error {
+			return withTx(db, func(tx *sql.Tx) error {
+				hour := time.Now().Truncate(time.Hour).Unix()
+				for name, n := range pending {
+					_, err := tx.Exec(`INSERT INTO hits (name, hour, count) VALUES (?, ?, ?)
+						ON CONFLICT(name, hour) DO UPDATE SET count=count+excluded.count`, name, hour, n)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		},
+		func(err error) { logger.Error("recording hits", zap.Error(err)) },
+	)
+	return nil
+}
@@ -0,0 +1,114 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/png"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Images get renditions in modern formats stored as variant rows of the
+// same name, like "webp" and "avif" rows next to the original photo.jpg.
+// Serving them takes a files table with a variant column and
+//
+//	"variant": "{http.sqlitefs.image_formats}"
+//
+// which sqlite_file_server resolves from the Accept header of the request.
+
+// imageEncoders are the commands that write renditions, with {in} and {out}
+// standing for the files they read and write. Go has no encoders for these
+// formats, so they are made by the usual tools if installed.
+var imageEncoders = map[string][]string{
+	"webp": {"cwebp", "-quiet", "-q", "80", "{in}", "-o", "{out}"},
+	"avif": {"avifenc", "--speed", "6", "{in}", "{out}"},
+}
+
+// imageTypes are the content types of the rendition formats.
+var imageTypes = map[string]string{
+	"webp": "image/webp",
+	"avif": "image/avif",
+}
+
+// isImage reports whether name is an image renditions can be made of.
+func isImage(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+// optimizeImage returns content recompressed if that makes it smaller.
+// Only PNG is recompressed, being lossless; JPEG is kept as it is.
+func optimizeImage(name string, content []byte) []byte {
+	if strings.ToLower(filepath.Ext(name)) != ".png" {
+		return content
+	}
+	img, err := png.Decode(bytes.NewReader(content))
+	if err != nil {
+		return content
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, img); err != nil || buf.Len() >= len(content) {
+		return content
+	}
+	return buf.Bytes()
+}
+
+// imageRenditions encodes content of the image name in each of formats,
+// leaving out renditions that aren't smaller than the original.
+func imageRenditions(ctx context.Context, name string, content []byte, formats []string) (map[string][]byte, error) {
+	dir, err := os.MkdirTemp("", "sqlitefs-images")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in"+strings.ToLower(filepath.Ext(name)))
+	if err := os.WriteFile(in, content, 0o600); err != nil {
+		return nil, err
+	}
+
+	renditions := make(map[string][]byte)
+	for _, format := range formats {
+		command, ok := imageEncoders[format]
+		if !ok {
+			return nil, fmt.Errorf("unknown image format %q", format)
+		}
+		out := filepath.Join(dir, "out."+format)
+		args := make([]string, len(command)-1)
+		for i, arg := range command[1:] {
+			args[i] = strings.NewReplacer("{in}", in, "{out}", out).Replace(arg)
+		}
+		if msg, err := exec.CommandContext(ctx, command[0], args...).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("encoding %s as %s: %v: %s", name, format, err, bytes.TrimSpace(msg))
+		}
+		encoded, err := os.ReadFile(out)
+		if err != nil {
+			return nil, err
+		}
+		if len(encoded) < len(content) {
+			renditions[format] = encoded
+		}
+	}
+	return renditions, nil
+}
+
+// acceptedImageFormats returns the rendition formats the request accepts
+// as a variant list, smallest first: "avif,webp", "webp", or "" for the
+// original only.
+func acceptedImageFormats(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	var formats []string
+	for _, format := range []string{"avif", "webp"} {
+		if strings.Contains(accept, imageTypes[format]) {
+			formats = append(formats, format)
+		}
+	}
+	return strings.Join(formats, ",")
+}
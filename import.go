@@ -0,0 +1,307 @@
+package sqlitefs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+// importFile is a file found in the directory being imported.
+type importFile struct {
+	path string // on disk
+	name string // in the database
+	info fs.FileInfo
+}
+
+func cmdImport(fl caddycmd.Flags) (int, error) {
+	dir, dbPath := fl.Arg(0), fl.Arg(1)
+	prefix := strings.Trim(fl.String("prefix"), "/")
+	if prefix != "" && !fs.ValidPath(prefix) {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid prefix %q", prefix)
+	}
+	var expiredAt time.Time
+	if ttl := fl.String("ttl"); ttl != "" {
+		d, err := caddy.ParseDuration(ttl)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("ttl: %w", err)
+		}
+		expiredAt = time.Now().Add(d)
+	}
+	var formats []string
+	if images := fl.String("images"); images != "" {
+		formats = strings.Split(images, ",")
+		for _, format := range formats {
+			if _, ok := imageTypes[format]; !ok {
+				return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown image format %q", format)
+			}
+		}
+	}
+
+	if err := createSchema(dbPath); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	s, err := cliFS(dbPath, fl.String("dataset"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer s.Cleanup()
+	if s.Dataset != "" && !s.columns["dataset"] {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--dataset: files table of %s has no dataset column", dbPath)
+	}
+	if len(formats) > 0 && !s.columns["variant"] {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--images: files table of %s has no variant column", dbPath)
+	}
+
+	files, err := walkImport(dir, prefix)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	imp := importer{fsys: s, expiredAt: expiredAt, formats: formats}
+	if fl.Bool("fingerprint") {
+		if err := imp.fingerprint(files); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+	ctx := context.Background()
+	for _, f := range files {
+		if err := imp.importFile(ctx, f); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+	if imp.manifest != nil {
+		if err := imp.writeManifest(ctx, prefix); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+	fmt.Printf("imported %d files (%s) into %s\n", imp.files, humanize.IBytes(uint64(imp.bytes)), dbPath)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// createSchema creates the database dbPath, or brings its schema up to
+// date.
+func createSchema(dbPath string) error {
+	db, err := openSQLite(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		return fmt.Errorf("%s: %w", dbPath, err)
+	}
+	return nil
+}
+
+// cliFS provisions a file system of dbPath outside of a config, for the
+// commands.
+func cliFS(dbPath, dataset string) (*SQLiteFS, error) {
+	s := &SQLiteFS{DBPath: dbPath, Dataset: dataset, MaxListEntries: -1}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		return nil, err
+	}
+	// rather than the development logger of a context without a config
+	s.logger = caddy.Log()
+	if s.db == nil {
+		return nil, fmt.Errorf("opening %s", dbPath)
+	}
+	return s, nil
+}
+
+// walkImport returns the regular files and symlinks below dir, named as in
+// the database.
+func walkImport(dir, prefix string) ([]importFile, error) {
+	var files []importFile
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && info.Mode()&fs.ModeSymlink == 0 {
+			caddy.Log().Warn("skipping file that is neither regular nor a symlink", zap.String("path", p))
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, importFile{path: p, name: path.Join(prefix, filepath.ToSlash(rel)), info: info})
+		return nil
+	})
+	return files, err
+}
+
+type importer struct {
+	fsys      *SQLiteFS
+	expiredAt time.Time
+	formats   []string
+
+	// original names of fingerprinted files to their fingerprinted names,
+	// nil without --fingerprint
+	manifest map[string]string
+
+	files int
+	bytes int64
+}
+
+// fingerprint fills the manifest with the fingerprinted names of the assets
+// among files: everything but pages and symlinks. Stylesheets are hashed
+// after their own references are rewritten, so a changed image changes the
+// names of the stylesheets using it too.
+func (imp *importer) fingerprint(files []importFile) error {
+	imp.manifest = make(map[string]string)
+	var stylesheets []importFile
+	for _, f := range files {
+		if !f.info.Mode().IsRegular() || isPage(f.name) {
+			continue
+		}
+		if strings.ToLower(path.Ext(f.name)) == ".css" {
+			stylesheets = append(stylesheets, f)
+			continue
+		}
+		content, err := imp.read(f)
+		if err != nil {
+			return err
+		}
+		imp.manifest[f.name] = fingerprintedName(f.name, content)
+	}
+	hashed := make(map[string]string, len(stylesheets))
+	for _, f := range stylesheets {
+		content, err := imp.read(f)
+		if err != nil {
+			return err
+		}
+		hashed[f.name] = fingerprintedName(f.name, content)
+	}
+	for name, h := range hashed {
+		imp.manifest[name] = h
+	}
+	return nil
+}
+
+// read returns the content of f as it is stored, rewritten and optimized.
+func (imp *importer) read(f importFile) ([]byte, error) {
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if len(imp.formats) > 0 && isImage(f.name) {
+		content = optimizeImage(f.name, content)
+	}
+	if imp.manifest != nil {
+		content = rewriteAssets(f.name, content, imp.manifest)
+	}
+	return content, nil
+}
+
+// importFile writes f, and its renditions and the assets of a page.
+func (imp *importer) importFile(ctx context.Context, f importFile) error {
+	s := imp.fsys
+	opts := WriteOptions{Mode: f.info.Mode(), Modified: f.info.ModTime(), ExpiredAt: imp.expiredAt}
+	var content []byte
+	if f.info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(f.path)
+		if err != nil {
+			return err
+		}
+		if _, ok := linkTarget(f.name, filepath.ToSlash(target)); !ok || filepath.IsAbs(target) {
+			s.logger.Warn("skipping symlink to outside the imported directory", zap.String("path", f.path), zap.String("target", target))
+			return nil
+		}
+		content = []byte(filepath.ToSlash(target))
+	} else {
+		var err error
+		if content, err = imp.read(f); err != nil {
+			return err
+		}
+		opts.Mode = f.info.Mode().Perm()
+	}
+
+	name := f.name
+	if hashed, ok := imp.manifest[name]; ok {
+		name = hashed
+		if s.aliases {
+			// the original name keeps working for references left alone
+			_, err := s.db.ExecContext(ctx, "INSERT OR REPLACE INTO aliases (alias, target) VALUES (?, ?)", f.name, name)
+			if err != nil {
+				return fmt.Errorf("aliasing %s: %w", f.name, err)
+			}
+		}
+	}
+	if _, err := s.WriteFileContext(ctx, name, content, opts); err != nil {
+		return fmt.Errorf("importing %s: %w", f.path, err)
+	}
+	imp.files++
+	imp.bytes += int64(len(content))
+
+	if isPage(name) && s.assets {
+		if err := imp.writeAssets(ctx, name, content); err != nil {
+			return err
+		}
+	}
+	if len(imp.formats) > 0 && isImage(name) && opts.Mode.IsRegular() {
+		renditions, err := imageRenditions(ctx, name, content, imp.formats)
+		if err != nil {
+			s.logger.Warn("skipping image renditions", zap.String("name", name), zap.Error(err))
+			return nil
+		}
+		for format, rendition := range renditions {
+			opts.Variant = format
+			if _, err := s.WriteFileContext(ctx, name, rendition, opts); err != nil {
+				return fmt.Errorf("importing %s rendition of %s: %w", format, f.path, err)
+			}
+			imp.bytes += int64(len(rendition))
+		}
+	}
+	return nil
+}
+
+// writeAssets replaces the assets of the page name in the assets table, so
+// prefetching doesn't have to parse it.
+func (imp *importer) writeAssets(ctx context.Context, name string, page []byte) error {
+	s := imp.fsys
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM assets WHERE name=?", name); err != nil {
+		return fmt.Errorf("storing assets of %s: %w", name, err)
+	}
+	for _, asset := range htmlAssets(name, page) {
+		_, err := s.db.ExecContext(ctx, "INSERT OR IGNORE INTO assets (name, asset) VALUES (?, ?)", name, asset)
+		if err != nil {
+			return fmt.Errorf("storing assets of %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// writeManifest stores the manifest as manifest.json in the prefix, for
+// pages and scripts built elsewhere to look up fingerprinted names in.
+func (imp *importer) writeManifest(ctx context.Context, prefix string) error {
+	manifest, err := json.MarshalIndent(imp.manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	name := path.Join(prefix, "manifest.json")
+	if _, err := imp.fsys.WriteFileContext(ctx, name, manifest, WriteOptions{ExpiredAt: imp.expiredAt}); err != nil {
+		return fmt.Errorf("storing %s: %w", name, err)
+	}
+	return nil
+}
+
+func isPage(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".html", ".htm":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package sqlitefs
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// startKeepalive checks the database every Keepalive, and closes the idle
+// connections when a query fails or the file was replaced, as when it is
+// rotated or its volume remounted, so new queries reopen it instead of
+// failing or serving the old file. A failing query also makes lookups
+// fail fast until the database answers again.
+func (s *SQLiteFS) startKeepalive() {
+	if s.Keepalive <= 0 || s.db == nil {
+		return
+	}
+	done := make(chan struct{})
+	s.stopKeepalive = func() { close(done) }
+	db := s.db
+	logger := s.logger.With(zap.String("db_path", s.DBPath))
+	opened, _ := os.Stat(s.DBPath)
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(s.Keepalive))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			var reason error
+			if info, err := os.Stat(s.DBPath); err == nil && opened != nil && !os.SameFile(opened, info) {
+				reason = errors.New("database file was replaced")
+				opened = info
+			} else {
+				// reads the database header, so I/O errors show
+				var version int64
+				if err := db.QueryRow("PRAGMA schema_version").Scan(&version); err != nil {
+					reason = err
+					s.health.failed(err)
+				}
+			}
+			if reason == nil {
+				continue
+			}
+			logger.Warn("recycling database connections", zap.Error(reason))
+			recycleIdle(db, s.maxIdleConns())
+		}
+	}()
+}
@@ -0,0 +1,137 @@
+package sqlitefs
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A database of another layout is served through a temporary view named
+// files, created on each connection, which maps its table and columns onto
+// those of the files table. The view shadows a files table of the
+// database, and lookups through it still use the indexes of the table.
+
+// layoutColumns are the columns of the files table that can be mapped.
+var layoutColumns = []string{"name", "content", "modified", "mode", "expired_at"}
+
+// mapsLayout reports whether files is a view of another layout.
+func (s SQLiteFS) mapsLayout() bool {
+	return s.Table != "" || s.Query != "" || len(s.layoutMapping()) > 0
+}
+
+// layoutMapping returns the configured columns of Table by the files
+// column they stand for.
+func (s SQLiteFS) layoutMapping() map[string]string {
+	mapping := make(map[string]string)
+	for col, src := range map[string]string{
+		"name":       s.NameColumn,
+		"content":    s.ContentColumn,
+		"modified":   s.ModifiedColumn,
+		"mode":       s.ModeColumn,
+		"expired_at": s.ExpiresColumn,
+	} {
+		if src != "" {
+			mapping[col] = src
+		}
+	}
+	return mapping
+}
+
+// filesView returns a connect hook creating the files view of the layout,
+// and a key telling apart the hooks of different layouts.
+func (s SQLiteFS) filesView() (string, func(sqliteConn) error) {
+	table, query, mapping := s.Table, s.Query, s.layoutMapping()
+	if table == "" {
+		table = "files"
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprint(table, query, mapping)))
+	key := "view_" + hex.EncodeToString(sum[:8])
+
+	return key, func(conn sqliteConn) error {
+		ctx := context.Background()
+		schema := "main"
+		if query != "" {
+			// mapped like a table, for the optional columns it leaves out
+			if _, err := conn.ExecContext(ctx, "CREATE TEMP VIEW IF NOT EXISTS files_query AS "+query, nil); err != nil {
+				return fmt.Errorf("creating view of query: %w", err)
+			}
+			schema, table = "temp", "files_query"
+		}
+		q, err := layoutQuery(ctx, conn, schema, table, mapping)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, "CREATE TEMP VIEW IF NOT EXISTS files AS "+q, nil); err != nil {
+			return fmt.Errorf("creating files view: %w", err)
+		}
+		return nil
+	}
+}
+
+// layoutQuery returns the SELECT of the files view of table in schema: the mapped
+// columns under the names of the files columns, columns of those names
+// that aren't mapped, NULL for missing optional ones, and the other
+// columns of table as they are, for the optional features.
+func layoutQuery(ctx context.Context, conn sqliteConn, schema, table string, mapping map[string]string) (string, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT name FROM pragma_table_info(?, ?)", []driver.NamedValue{
+		{Ordinal: 1, Value: table},
+		{Ordinal: 2, Value: schema},
+	})
+	if err != nil {
+		return "", fmt.Errorf("inspecting %s: %w", table, err)
+	}
+	var columns []string
+	has := make(map[string]bool)
+	values := make([]driver.Value, 1)
+	for {
+		err := rows.Next(values)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rows.Close()
+			return "", fmt.Errorf("inspecting %s: %w", table, err)
+		}
+		col, _ := values[0].(string)
+		columns = append(columns, col)
+		has[col] = true
+	}
+	rows.Close()
+	if len(columns) == 0 {
+		return "", fmt.Errorf("no table %s", table)
+	}
+
+	used := make(map[string]bool)
+	var selects []string
+	for _, col := range layoutColumns {
+		src, ok := mapping[col]
+		switch {
+		case ok && !has[src]:
+			return "", fmt.Errorf("table %s has no column %s", table, src)
+		case ok:
+		case has[col]:
+			src = col
+		case col == "name" || col == "content":
+			return "", fmt.Errorf("table %s has no %s column, map one with %s_column", table, col, col)
+		default:
+			selects = append(selects, "NULL AS "+quoteIdent(col))
+			continue
+		}
+		selects = append(selects, quoteIdent(src)+" AS "+quoteIdent(col))
+		used[src] = true
+	}
+	for _, col := range layoutColumns {
+		// shadowed by a mapped column
+		used[col] = true
+	}
+	for _, col := range columns {
+		if !used[col] {
+			selects = append(selects, quoteIdent(col))
+		}
+	}
+	return "SELECT " + strings.Join(selects, ", ") + " FROM " + schema + "." + quoteIdent(table), nil
+}
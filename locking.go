@@ -0,0 +1,56 @@
+package sqlitefs
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// Exclusive locks belong to a connection, so instances of the same
+// database in the old and new config of a reload share theirs instead of
+// waiting for each other.
+var (
+	exclusiveMu  sync.Mutex
+	exclusiveDBs = make(map[string]*exclusiveDB)
+)
+
+type exclusiveDB struct {
+	db   *sql.DB
+	refs int
+}
+
+// openExclusive returns the single-connection handle of dsn, opening it
+// if no other instance has it open.
+func openExclusive(driver, dsn string) (*sql.DB, error) {
+	exclusiveMu.Lock()
+	defer exclusiveMu.Unlock()
+	key := driver + " " + dsn
+	if e, ok := exclusiveDBs[key]; ok {
+		e.refs++
+		return e.db, nil
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	exclusiveDBs[key] = &exclusiveDB{db: db, refs: 1}
+	return db, nil
+}
+
+// closeExclusive gives up a handle from openExclusive, closing it,
+// and so releasing the lock, once no instance uses it.
+func closeExclusive(db *sql.DB) error {
+	exclusiveMu.Lock()
+	defer exclusiveMu.Unlock()
+	for key, e := range exclusiveDBs {
+		if e.db != db {
+			continue
+		}
+		if e.refs--; e.refs > 0 {
+			return nil
+		}
+		delete(exclusiveDBs, key)
+		return db.Close()
+	}
+	return db.Close()
+}
@@ -0,0 +1,37 @@
+package sqlitefs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// instanceLogger returns the logger of this instance, named after Name or
+// the database file so its logs can be told apart from other instances'
+// and selected with include/exclude in the logging config.
+func (s *SQLiteFS) instanceLogger(ctx caddy.Context) (*zap.Logger, error) {
+	// dots separate logger names
+	logger := ctx.Logger().Named(strings.ReplaceAll(s.instanceName(), ".", "_"))
+	if s.LogLevel == "" {
+		return logger, nil
+	}
+	level, err := zapcore.ParseLevel(s.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("log_level: %w", err)
+	}
+	return logger.WithOptions(zap.IncreaseLevel(level)), nil
+}
+
+// instanceName is Name, or else the base name of the database file without
+// its extension.
+func (s SQLiteFS) instanceName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	base := filepath.Base(s.DBPath)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
@@ -0,0 +1,272 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(LogWriter{})
+}
+
+// LogWriter appends log entries to a table in a sqlite database. With the
+// default json encoder entries can be queried with the json1 functions,
+// e.g. json_extract(entry, '$.request.uri').
+type LogWriter struct {
+	DBPath string `json:"db_path,omitempty"`
+
+	// Table to append to, created if missing. Default: logs.
+	Table string `json:"table,omitempty"`
+
+	// Delete entries older than this. Zero keeps everything.
+	Retain caddy.Duration `json:"retain,omitempty"`
+
+	// Keep at most this many entries, dropping the oldest. Zero means no limit.
+	MaxRows int64 `json:"max_rows,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (LogWriter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.logging.writers.sqlite",
+		New: func() caddy.Module { return new(LogWriter) },
+	}
+}
+
+func (w *LogWriter) Provision(ctx caddy.Context) error {
+	if w.Table == "" {
+		w.Table = "logs"
+	}
+	return nil
+}
+
+func (w *LogWriter) Validate() error {
+	if w.DBPath == "" {
+		return errors.New("db_path is required")
+	}
+	if w.Retain < 0 || w.MaxRows < 0 {
+		return errors.New("retain and max_rows cannot be negative")
+	}
+	return nil
+}
+
+func (w LogWriter) String() string { return "sqlite:" + w.DBPath + ":" + w.Table }
+
+// WriterKey implements caddy.WriterOpener.
+func (w LogWriter) WriterKey() string { return "sqlite:" + w.DBPath + ":" + w.Table }
+
+// OpenWriter implements caddy.WriterOpener.
+func (w LogWriter) OpenWriter() (io.WriteCloser, error) {
+	db, err := openSQLite(w.DBPath)
+	if err != nil {
+		return nil, err
+	}
+	table := quoteIdent(w.Table)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (
+		"ts" INTEGER, -- unix timestamp in nanoseconds
+		"entry" TEXT
+	);
+	CREATE INDEX IF NOT EXISTS ` + quoteIdent(w.Table+"_ts") + ` ON ` + table + ` ("ts")`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating log table: %w", err)
+	}
+
+	lw := &logTableWriter{
+		cfg:     w,
+		db:      db,
+		table:   table,
+		entries: make(chan logEntry, 1024),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go lw.run()
+	return lw, nil
+}
+
+type logEntry struct {
+	ts    int64
+	entry string
+}
+
+// logTableWriter batches entries in a background goroutine so logging
+// never waits on the database. entries is never closed, as loggers of an
+// old config can still write while it is closed on a reload; closing
+// tells run to finish instead.
+type logTableWriter struct {
+	cfg     LogWriter
+	db      *sql.DB
+	table   string
+	entries chan logEntry
+	closing chan struct{}
+	done    chan struct{}
+
+	closeOnce sync.Once
+}
+
+func (lw *logTableWriter) Write(p []byte) (int, error) {
+	e := logEntry{ts: time.Now().UnixNano(), entry: string(bytes.TrimRight(p, "\n"))}
+	select {
+	case <-lw.closing:
+		return 0, os.ErrClosed
+	default:
+	}
+	select {
+	case lw.entries <- e:
+	default:
+		// the database can't keep up; dropping beats stalling requests
+		fmt.Fprintf(os.Stderr, "sqlite log writer %s: buffer full, dropped entry\n", lw.cfg)
+	}
+	return len(p), nil
+}
+
+func (lw *logTableWriter) Close() error {
+	lw.closeOnce.Do(func() { close(lw.closing) })
+	<-lw.done
+	return lw.db.Close()
+}
+
+func (lw *logTableWriter) run() {
+	defer close(lw.done)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+
+	var batch []logEntry
+	for {
+		select {
+		case e := <-lw.entries:
+			batch = append(batch, e)
+			if len(batch) >= 256 {
+				lw.insert(batch)
+				batch = batch[:0]
+			}
+		case <-flush.C:
+			lw.insert(batch)
+			batch = batch[:0]
+		case <-prune.C:
+			lw.prune()
+		case <-lw.closing:
+			// with what was written before
+			for {
+				select {
+				case e := <-lw.entries:
+					batch = append(batch, e)
+				default:
+					lw.insert(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (lw *logTableWriter) insert(batch []logEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	err := withTx(lw.db, func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare("INSERT INTO " + lw.table + " (ts, entry) VALUES (?, ?)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, e := range batch {
+			if _, err := stmt.Exec(e.ts, e.entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sqlite log writer %s: dropped %d entries: %v\n", lw.cfg, len(batch), err)
+	}
+}
+
+// prune applies the retention settings.
+func (lw *logTableWriter) prune() {
+	var err error
+	if lw.cfg.Retain > 0 {
+		cutoff := time.Now().Add(-time.Duration(lw.cfg.Retain)).UnixNano()
+		_, err = lw.db.Exec("DELETE FROM "+lw.table+" WHERE ts < ?", cutoff)
+	}
+	if err == nil && lw.cfg.MaxRows > 0 {
+		_, err = lw.db.Exec("DELETE FROM "+lw.table+" WHERE rowid <= (SELECT max(rowid) FROM "+lw.table+") - ?", lw.cfg.MaxRows)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sqlite log writer %s: pruning: %v\n", lw.cfg, err)
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	sqlite <db_path> {
+//		table    <name>
+//		retain   <duration>
+//		max_rows <count>
+//	}
+func (w *LogWriter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			w.DBPath = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "db_path":
+				if !d.AllArgs(&w.DBPath) {
+					return d.ArgErr()
+				}
+			case "table":
+				if !d.AllArgs(&w.Table) {
+					return d.ArgErr()
+				}
+			case "retain":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing retain: %v", err)
+				}
+				w.Retain = caddy.Duration(dur)
+			case "max_rows":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.ParseInt(d.Val(), 10, 64)
+				if err != nil {
+					return d.Errf("parsing max_rows: %v", err)
+				}
+				w.MaxRows = n
+			default:
+				return d.Errf("unrecognized parameter '%s'", d.Val())
+			}
+		}
+	}
+	if w.DBPath == "" {
+		return d.Err("missing db_path")
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.WriterOpener    = (*LogWriter)(nil)
+	_ caddy.Provisioner     = (*LogWriter)(nil)
+	_ caddy.Validator       = (*LogWriter)(nil)
+	_ caddyfile.Unmarshaler = (*LogWriter)(nil)
+)
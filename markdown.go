@@ -0,0 +1,122 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"go.uber.org/zap"
+)
+
+// markdown renders GitHub Flavored Markdown with ids on headings, so
+// sections can be linked to. Raw HTML in the source is left out.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+)
+
+func isMarkdown(name string) bool {
+	return path.Ext(name) == ".md"
+}
+
+// markdownSource returns the name of the Markdown file a page is rendered
+// from, page.md for page.html.
+func markdownSource(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + ".md"
+}
+
+// acceptsHTML reports whether the request asks for HTML, as browsers do
+// when following links.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// renderMarkdown returns source rendered as an HTML page and the hex
+// SHA-256 of source. Pages are kept in the rendered table if the database
+// has one, so each version of a source is rendered once.
+func (s SQLiteFS) renderMarkdown(ctx context.Context, source []byte) ([]byte, string, error) {
+	sum := sha256.Sum256(source)
+	hash := hex.EncodeToString(sum[:])
+	if s.rendered {
+		var page []byte
+		err := s.db.QueryRowContext(ctx, "SELECT html FROM rendered WHERE hash=?", hash).Scan(&page)
+		if err == nil {
+			return page, hash, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, "", err
+		}
+	}
+
+	page, err := renderPage(source)
+	if err != nil {
+		return nil, "", err
+	}
+	if s.rendered && s.wdb != nil {
+		_, err := s.wdb.ExecContext(ctx, "INSERT OR REPLACE INTO rendered (hash, html, rendered_at) VALUES (?, ?, ?)", hash, page, time.Now().Unix())
+		if err != nil {
+			s.logger.Debug("storing rendered markdown", zap.String("hash", hash), zap.Error(err))
+		}
+	}
+	return page, hash, nil
+}
+
+// renderPage renders source into a standalone HTML page titled with its
+// first heading.
+func renderPage(source []byte) ([]byte, error) {
+	doc := markdown.Parser().Parse(text.NewReader(source))
+	var title string
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if h, ok := n.(*ast.Heading); ok && entering {
+			title = string(h.Text(source))
+			return ast.WalkStop, nil
+		}
+		return ast.WalkContinue, nil
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n", html.EscapeString(title))
+	if err := markdown.Renderer().Render(&buf, source, doc); err != nil {
+		return nil, err
+	}
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes(), nil
+}
+
+// serveMarkdown serves the Markdown file f rendered as HTML.
+func (fsrv *FileServer) serveMarkdown(w http.ResponseWriter, r *http.Request, f fs.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	source, err := io.ReadAll(f)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	page, hash, err := fsrv.fsys.renderMarkdown(r.Context(), source)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("rendering %s: %w", info.Name(), err))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// replacing any tag of the source, which is served under the same name
+	w.Header().Set("Etag", `"`+hash+`-html"`)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(page))
+	return nil
+}
@@ -0,0 +1,202 @@
+package sqlitefs
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// MemoryCache keeps recently opened files in memory, so requests for hot
+// files such as stylesheets and icons don't query the database at all.
+// Entries are dropped after TTL, when the database file's modification
+// time changes, and on writes through this file system. Changes made
+// by other processes can take until then to be seen.
+type MemoryCache struct {
+	// The most content to keep, in bytes. Default: 64MiB.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// The most files to keep. Default: 10000.
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// How long a file is kept after it was loaded. Default: 1m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+// memoryCache is the least recently used cache of a MemoryCache.
+type memoryCache struct {
+	maxBytes   int64
+	maxEntries int
+	ttl        time.Duration
+	dbPath     string
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // of *cacheEntry, most recently used first
+	bytes   int64
+	checked time.Time // when the database file was last looked at
+	dbStat  fs.FileInfo
+}
+
+type cacheEntry struct {
+	key      string
+	row      fileRow
+	deadline time.Time
+}
+
+func newMemoryCache(c MemoryCache, dbPath string) *memoryCache {
+	mc := &memoryCache{
+		maxBytes:   c.MaxBytes,
+		maxEntries: c.MaxEntries,
+		ttl:        time.Duration(c.TTL),
+		dbPath:     dbPath,
+		entries:    make(map[string]*list.Element),
+	}
+	if mc.maxBytes <= 0 {
+		mc.maxBytes = 64 << 20
+	}
+	if mc.maxEntries <= 0 {
+		mc.maxEntries = 10000
+	}
+	if mc.ttl <= 0 {
+		mc.ttl = time.Minute
+	}
+	mc.dbStat, _ = os.Stat(dbPath)
+	mc.checked = time.Now()
+	return mc
+}
+
+// get returns a copy of the row cached under key.
+func (c *memoryCache) get(key string) (*fileRow, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkDB()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.deadline) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	row := e.row
+	return &row, true
+}
+
+// put caches row under key until the TTL has passed or the row expires,
+// evicting the least recently used entries to make room.
+func (c *memoryCache) put(key string, row fileRow) {
+	size := entrySize(key, row)
+	if size > c.maxBytes {
+		return
+	}
+	deadline := time.Now().Add(c.ttl)
+	if !row.expiresAt.IsZero() && row.expiresAt.Before(deadline) {
+		deadline = row.expiresAt
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, row: row, deadline: deadline})
+	c.bytes += size
+	for c.bytes > c.maxBytes || len(c.entries) > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// clear drops every entry, after this file system changed rows.
+func (c *memoryCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clearLocked()
+}
+
+func (c *memoryCache) clearLocked() {
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+}
+
+func (c *memoryCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.bytes -= entrySize(e.key, e.row)
+}
+
+// checkDB clears the cache if the database file changed, looking at most
+// once a second.
+func (c *memoryCache) checkDB() {
+	if time.Since(c.checked) < time.Second {
+		return
+	}
+	c.checked = time.Now()
+	info, err := os.Stat(c.dbPath)
+	if err != nil || c.dbStat == nil || !info.ModTime().Equal(c.dbStat.ModTime()) || info.Size() != c.dbStat.Size() {
+		c.clearLocked()
+	}
+	c.dbStat = info
+}
+
+// entrySize is about what an entry takes in memory.
+func entrySize(key string, row fileRow) int64 {
+	return int64(len(key)+len(row.content)+len(row.compressed)+len(row.info.name)) + 256
+}
+
+// cacheKey tells apart the rows of name that differ by what ctx selects.
+func (s SQLiteFS) cacheKey(ctx context.Context, name string, hops int) (string, bool) {
+	filter, args, ok := s.rowFilter(ctx)
+	if !ok {
+		return "", false
+	}
+	order, orderArgs := s.latestFirst(ctx)
+	return fmt.Sprintf("%q %d %q %q %q %q", name, hops, filter, args, order, orderArgs), true
+}
+
+// lookupCached is lookup through the memory cache, if there is one. With
+// fill, rows it doesn't have are loaded whole and added to it.
+func (s SQLiteFS) lookupCached(ctx context.Context, name string, hops int, fill bool) (*fileRow, error) {
+	if s.memCache == nil {
+		return s.lookup(ctx, name, hops)
+	}
+	key, ok := s.cacheKey(ctx, name, hops)
+	if !ok {
+		return s.lookup(ctx, name, hops)
+	}
+	row, ok := s.memCache.get(key)
+	s.metrics.cacheLookup(ok)
+	if ok {
+		return row, nil
+	}
+	row, err := s.lookup(ctx, name, hops)
+	if err != nil || !fill || !s.cacheable(row) {
+		return row, err
+	}
+	if row.content == nil && !row.info.IsDir() {
+		if row.content, err = s.loadContent(ctx, row.info.name, row.key); err != nil {
+			return nil, err
+		}
+	}
+	s.memCache.put(key, *row)
+	return row, nil
+}
+
+// cacheable reports whether row can be served from memory: it is loaded
+// whole, and opening it has no effect on the database.
+func (s SQLiteFS) cacheable(row *fileRow) bool {
+	switch {
+	case row.limited, row.chunked(), row.external != nil && *row.external != "":
+		return false
+	case s.StreamThreshold > 0 && row.info.size > s.StreamThreshold:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package sqlitefs
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics are registered like Caddy's own, with the default registry
+// that the admin endpoint serves at /metrics, and labeled with the name of
+// the instance, Name or the base name of the database file.
+
+var fsMetrics = struct {
+	init          sync.Once
+	opens         *prometheus.CounterVec
+	cacheRequests *prometheus.CounterVec
+	queryDuration *prometheus.HistogramVec
+	readBytes     *prometheus.CounterVec
+}{}
+
+func initMetrics() {
+	const ns, sub = "caddy", "sqlitefs"
+
+	fsMetrics.opens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "opens_total",
+		Help:      "Files opened, by result: ok, not_found, db_error or error.",
+	}, []string{"db", "result"})
+	fsMetrics.cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "memory_cache_requests_total",
+		Help:      "Lookups through the memory cache, by result: hit or miss.",
+	}, []string{"db", "result"})
+	// sqlite answers most lookups well under a millisecond
+	fsMetrics.queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "query_duration_seconds",
+		Help:      "Histogram of database query durations, by query: lookup, content, chunk or readdir.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 9),
+	}, []string{"db", "query"})
+	fsMetrics.readBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "read_bytes_total",
+		Help:      "Bytes of content read from the database.",
+	}, []string{"db"})
+}
+
+// instanceMetrics are the metrics of one instance. A nil *instanceMetrics,
+// of an instance that wasn't provisioned, records nothing.
+type instanceMetrics struct {
+	opens         map[string]prometheus.Counter
+	cacheHits     prometheus.Counter
+	cacheMisses   prometheus.Counter
+	queryDuration prometheus.ObserverVec
+	readBytes     prometheus.Counter
+}
+
+func newInstanceMetrics(name string) *instanceMetrics {
+	fsMetrics.init.Do(initMetrics)
+	labels := prometheus.Labels{"db": name}
+	m := &instanceMetrics{
+		opens:         make(map[string]prometheus.Counter),
+		cacheHits:     fsMetrics.cacheRequests.With(prometheus.Labels{"db": name, "result": "hit"}),
+		cacheMisses:   fsMetrics.cacheRequests.With(prometheus.Labels{"db": name, "result": "miss"}),
+		queryDuration: fsMetrics.queryDuration.MustCurryWith(labels),
+		readBytes:     fsMetrics.readBytes.With(labels),
+	}
+	for _, result := range []string{"ok", "not_found", "db_error", "error"} {
+		m.opens[result] = fsMetrics.opens.With(prometheus.Labels{"db": name, "result": result})
+	}
+	return m
+}
+
+// opened counts an open that returned err.
+func (m *instanceMetrics) opened(err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrDatabase):
+		result = "db_error"
+	case errors.Is(err, fs.ErrNotExist):
+		result = "not_found"
+	default:
+		result = "error"
+	}
+	m.opens[result].Inc()
+}
+
+// cacheLookup counts a lookup through the memory cache.
+func (m *instanceMetrics) cacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.cacheHits.Inc()
+	} else {
+		m.cacheMisses.Inc()
+	}
+}
+
+// queried records how long query took since start.
+func (m *instanceMetrics) queried(query string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.queryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// read counts n bytes of content read from the database.
+func (m *instanceMetrics) read(n int) {
+	if m == nil {
+		return
+	}
+	m.readBytes.Add(float64(n))
+}
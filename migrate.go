@@ -0,0 +1,201 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// schema creates the files table and the optional tables.
+//
+//go:embed schema.sql
+var schema string
+
+const schemaVersionSchema = `
+CREATE TABLE IF NOT EXISTS "schema_version" (
+	"version" INTEGER -- the number of migrations applied
+);
+`
+
+// migrations bring the schema of a database from the version of their
+// index to the next one. Each runs in a transaction with the update of the
+// version, and must work on databases created by hand as well, which
+// start from version 0 whatever they contain. New ones are appended.
+var migrations = []func(*sql.Tx) error{
+	// the tables of schema.sql, unless the database has a files table of
+	// its own, and an index for finding expired rows
+	func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRow("SELECT count(*) FROM sqlite_master WHERE name='files'").Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			_, err := tx.Exec(schema)
+			return err
+		}
+		if err := tx.QueryRow("SELECT count(*) FROM pragma_table_info('files') WHERE name='expired_at'").Scan(&n); err != nil || n == 0 {
+			return err
+		}
+		_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS "files_expired_at" ON "files" ("expired_at")`)
+		return err
+	},
+
+	// the chunks column and the file_chunks table of schema.sql, unless
+	// files is a view
+	func(tx *sql.Tx) error {
+		ok, err := addFilesColumn(tx, "chunks")
+		if err != nil || !ok {
+			return err
+		}
+		_, err = tx.Exec(chunksSchema)
+		return err
+	},
+
+	// the compression column, unless files is a view
+	func(tx *sql.Tx) error {
+		_, err := addFilesColumn(tx, "compression")
+		return err
+	},
+
+	// the content_type column, unless files is a view
+	func(tx *sql.Tx) error {
+		_, err := addFilesColumn(tx, "content_type")
+		return err
+	},
+}
+
+// addFilesColumn adds the TEXT column col to the files table if it doesn't have
+// it, reporting whether files is a table.
+func addFilesColumn(tx *sql.Tx, col string) (bool, error) {
+	var n int
+	if err := tx.QueryRow("SELECT count(*) FROM sqlite_master WHERE name='files' AND type='table'").Scan(&n); err != nil || n == 0 {
+		return false, err
+	}
+	if err := tx.QueryRow("SELECT count(*) FROM pragma_table_info('files') WHERE name=?", col).Scan(&n); err != nil {
+		return false, err
+	}
+	if n == 0 {
+		if _, err := tx.Exec(`ALTER TABLE "files" ADD COLUMN ` + quoteIdent(col) + ` TEXT`); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// chunksSchema is the part of schema.sql for chunked content.
+const chunksSchema = `
+CREATE TABLE IF NOT EXISTS "file_chunks" (
+	"id" TEXT,
+	"seq" INTEGER,
+	"data" BLOB,
+	PRIMARY KEY ("id", "seq")
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS "files_chunks" ON "files" ("chunks") WHERE "chunks" IS NOT NULL;
+CREATE TRIGGER IF NOT EXISTS "files_chunks_delete" AFTER DELETE ON "files"
+WHEN OLD."chunks" IS NOT NULL
+BEGIN
+	DELETE FROM "file_chunks" WHERE "id" = OLD."chunks"
+		AND NOT EXISTS (SELECT 1 FROM "files" WHERE "chunks" = OLD."chunks");
+END;
+CREATE TRIGGER IF NOT EXISTS "files_chunks_update" AFTER UPDATE OF "chunks" ON "files"
+WHEN OLD."chunks" IS NOT NULL AND OLD."chunks" IS NOT NEW."chunks"
+BEGIN
+	DELETE FROM "file_chunks" WHERE "id" = OLD."chunks"
+		AND NOT EXISTS (SELECT 1 FROM "files" WHERE "chunks" = OLD."chunks");
+END;
+`
+
+// createSchema migrates the database of s, from nothing if it is new.
+func (s *SQLiteFS) createSchema() error {
+	if s.readOnly {
+		s.logger.Warn("database is read-only, not creating or migrating its schema", zap.String("db_path", s.DBPath))
+		return nil
+	}
+	db := s.db
+	if !s.ExclusiveLocking {
+		// waiting for other writers rather than failing
+		wdb, err := s.sqliteDriver().openWriter(s.DBPath, s.writerSetup())
+		if err != nil {
+			return err
+		}
+		defer wdb.Close()
+		db = wdb
+	}
+	if db == nil {
+		return fmt.Errorf("opening %s", s.DBPath)
+	}
+	if err := migrate(db); err != nil {
+		return fmt.Errorf("%s: %w", s.DBPath, err)
+	}
+	return nil
+}
+
+// incrementalVacuum sets auto_vacuum to incremental if db is new, so
+// purge_expired can return the pages of deleted rows. Databases that have
+// tables need a VACUUM to change it.
+func incrementalVacuum(db *sql.DB) error {
+	var tables int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master").Scan(&tables); err != nil || tables > 0 {
+		return err
+	}
+	// on one connection, which the VACUUM writes it to the file from
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(context.Background(), "VACUUM")
+	return err
+}
+
+// migrate applies the migrations db hasn't had yet.
+func migrate(db *sql.DB) error {
+	if err := incrementalVacuum(db); err != nil {
+		return fmt.Errorf("setting auto_vacuum: %w", err)
+	}
+	if _, err := db.Exec(schemaVersionSchema); err != nil {
+		return fmt.Errorf("creating schema_version table: %w", err)
+	}
+	for {
+		done, err := migrateOnce(db)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateOnce applies the next migration db needs, if any, reporting
+// whether it was already up to date.
+func migrateOnce(db *sql.DB) (bool, error) {
+	done := false
+	err := withTx(db, func(tx *sql.Tx) error {
+		// takes the write lock before reading, so of concurrent migrations
+		// the later ones wait and then see the step done
+		if _, err := tx.Exec(`UPDATE schema_version SET version=version WHERE 0`); err != nil {
+			return err
+		}
+		var version int
+		if err := tx.QueryRow(`SELECT coalesce(max(version), 0) FROM schema_version`).Scan(&version); err != nil {
+			return err
+		}
+		if version >= len(migrations) {
+			done = true
+			return nil
+		}
+		if err := migrations[version](tx); err != nil {
+			return fmt.Errorf("migrating schema to version %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_version`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, version+1)
+		return err
+	})
+	return done, err
+}
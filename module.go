@@ -2,14 +2,22 @@ package sqlitefs
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/fs"
+	"net/http"
 	"path"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"go.uber.org/zap"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -22,7 +30,318 @@ func init() {
 type SQLiteFS struct {
 	DBPath string `json:"db_path,omitempty"`
 
-	db *sql.DB
+	// Serve from a table of another layout than the files table: Table,
+	// with the columns standing for name, content, modified, mode and
+	// expired_at named by these options. Unset ones keep the name they have
+	// in the files table, or are NULL if Table has no such column; its
+	// other columns keep their names. Such databases are read-only.
+	Table          string `json:"table,omitempty"`
+	NameColumn     string `json:"name_column,omitempty"`
+	ContentColumn  string `json:"content_column,omitempty"`
+	ModifiedColumn string `json:"modified_column,omitempty"`
+	ModeColumn     string `json:"mode_column,omitempty"`
+	ExpiresColumn  string `json:"expires_column,omitempty"`
+
+	// A SELECT used in place of the files table, with its columns, for
+	// layouts that column names can't map, such as joins. Replaces Table
+	// and the column options.
+	Query string `json:"query,omitempty"`
+
+	// Create the files table and the optional tables of schema.sql on
+	// Provision if the database has no files table, creating the database
+	// too, and apply the migrations of later schema versions.
+	CreateSchema bool `json:"create_schema,omitempty"`
+
+	// Names this instance's logger, so its logs can be told apart and
+	// selected in the logging config. Default: the database file name
+	// without extension.
+	Name string `json:"name,omitempty"`
+
+	// The least severe level this instance logs at, such as "warn" to
+	// quiet a noisy store. Logs below the level of the Caddy log they go
+	// to are dropped anyway; to debug one store, give a log that includes
+	// only its logger the debug level.
+	LogLevel string `json:"log_level,omitempty"`
+
+	// Count hits per file and hour in the hits table, and lookups of
+	// names that don't exist in the misses table.
+	TrackHits bool `json:"track_hits,omitempty"`
+
+	// Record when each file was last opened in the last_accessed column.
+	TrackAccess bool `json:"track_access,omitempty"`
+
+	// Sum the bytes served from files under each of these name prefixes
+	// in the bandwidth table. The longest matching prefix is charged.
+	AccountPrefixes []string `json:"account_prefixes,omitempty"`
+
+	// Sum the bytes served to each tenant too, under the key
+	// tenant:<tenant> of the bandwidth table.
+	AccountTenants bool `json:"account_tenants,omitempty"`
+
+	// Column holding the tenant a row belongs to. When set, only rows whose
+	// column equals the resolved Tenant are visible.
+	TenantColumn string `json:"tenant_column,omitempty"`
+
+	// The tenant of a lookup, usually a placeholder such as
+	// {http.request.host}. Request placeholders are only available when
+	// files are opened through the sqlite_file_server handler; an empty
+	// value matches no rows.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Limits on what each tenant may store, enforced by the write paths.
+	// Usage is computed from the database and cached for 30s.
+	TenantQuota *Quota `json:"tenant_quota,omitempty"`
+
+	// Reject writes without an If-Match header, so editors and jobs must
+	// say which version of a file they change and can't overwrite each
+	// other's changes unseen.
+	RequireIfMatch bool `json:"require_if_match,omitempty"`
+
+	// Limits on what may be stored in all, and under each of these name
+	// prefixes, enforced by the write paths like TenantQuota but counted
+	// anew for every write, over the rows of the tenant and dataset
+	// written that aren't deleted.
+	StorageQuota *Quota            `json:"storage_quota,omitempty"`
+	PrefixQuotas map[string]*Quota `json:"prefix_quotas,omitempty"`
+
+	// What writes over StorageQuota or PrefixQuotas do: "reject" (the
+	// default) fails them with ErrQuotaExceeded, "evict_oldest" deletes the
+	// least recently modified files under the limit, of the same tenant and
+	// dataset, until the write fits. With a deleted_at column they are soft
+	// deleted.
+	QuotaExceeded string `json:"quota_exceeded,omitempty"`
+
+	// What the write paths accept: sizes, types and names, and a scanner
+	// that must approve every file.
+	UploadPolicy *UploadPolicy `json:"upload_policy,omitempty"`
+
+	// Hide rows whose published column is 0 or NULL, unless the lookup
+	// is a preview.
+	RequirePublished bool `json:"require_published,omitempty"`
+
+	// A placeholder carrying the preview token of a request, for example
+	// {http.request.header.X-Preview} or {http.request.cookie.preview}.
+	Preview string `json:"preview,omitempty"`
+
+	// The token that makes Preview show unpublished rows, for example
+	// {env.PREVIEW_TOKEN}.
+	PreviewToken string `json:"preview_token,omitempty"`
+
+	// The version to serve from a files table with a version column, usually
+	// a placeholder. Empty serves the latest version.
+	Version string `json:"version,omitempty"`
+
+	// Serve the latest version at or below this one, usually a placeholder,
+	// for looking at the site as it was. Ignored when Version is set.
+	Generation string `json:"generation,omitempty"`
+
+	// The active label of a files table with a dataset column: only rows
+	// with this label are visible, or rows without one when empty. It can
+	// be switched at runtime through the admin API.
+	Dataset string `json:"dataset,omitempty"`
+
+	// Selects among the rows of a name in a files table with a variant
+	// column, usually a placeholder such as {http.request.cookie.ab}. Rows
+	// without a variant are the fallback and the only ones served when
+	// this is empty. A comma separated list serves the first variant of it
+	// that a name has.
+	Variant string `json:"variant,omitempty"`
+
+	// What lookups of expired rows do: "not_found" (the default), "gone"
+	// which fails with ErrGone so sqlite_file_server answers 410, or
+	// "stale" which keeps serving them for StaleGrace after they expire.
+	Expired string `json:"expired,omitempty"`
+
+	// How long expired rows are still served with "expired": "stale".
+	StaleGrace caddy.Duration `json:"stale_grace,omitempty"`
+
+	// Delete expired rows this often, once they are past StaleGrace with
+	// "expired": "stale", and return the pages they took to the file
+	// system if the database has auto_vacuum set to incremental.
+	// Default: off.
+	PurgeExpired caddy.Duration `json:"purge_expired,omitempty"`
+
+	// Fail lookups of rows hidden for these reasons with fs.ErrPermission,
+	// so sqlite_file_server answers 403, rather than as if they didn't
+	// exist: "private" (unpublished), "quota_exceeded" (out of downloads)
+	// and "tenant_mismatch" (belonging to another tenant).
+	PermissionDenied []string `json:"permission_denied,omitempty"`
+
+	// Fall back to a case-insensitive match for names that aren't found, so
+	// sqlite_file_server can redirect to the stored spelling.
+	CaseInsensitive bool `json:"case_insensitive,omitempty"`
+
+	// Order listings by, and with IgnoreCase or IgnoreDiacritics match
+	// missed names with, a Unicode collation.
+	Collation *Collation `json:"collation,omitempty"`
+
+	// Normalize requested names to this Unicode form before lookup, "nfc"
+	// or "nfd", matching how the names in the database were written. Files
+	// imported from macOS usually have NFD names.
+	UnicodeNormalization string `json:"unicode_normalization,omitempty"`
+
+	// Percent-decode requested names before lookup, for callers that pass
+	// names still escaped.
+	PercentDecode bool `json:"percent_decode,omitempty"`
+
+	// Locations that rows may point to in their external column, as path
+	// or URL prefixes such as /srv/media/ or https://cdn.example.com/,
+	// matched by whole path segments and, for URLs, by scheme and host.
+	// Content outside of them is refused; none are allowed by default.
+	ExternalPrefixes []string `json:"external_prefixes,omitempty"`
+
+	// How the content column is stored: "raw" (the default) or "base64",
+	// as is common for rows inserted through JSON APIs. An encoding column
+	// overrides it per row. TEXT content needs no setting.
+	ContentEncoding string `json:"content_encoding,omitempty"`
+
+	// Compress the content of writes with "gzip" or "zstd", stored with
+	// the name of the compression in the compression column. Rows with one
+	// are decompressed when served, whatever this is. Default: off.
+	Compression string `json:"compression,omitempty"`
+
+	// Small files served from the config instead of the database, by name,
+	// such as robots.txt or .well-known/security.txt. They take precedence
+	// over rows of the same name.
+	VirtualFiles map[string]string `json:"virtual_files,omitempty"`
+
+	// Other databases to serve below path prefixes, by prefix, such as
+	// "docs" for docs.db. They are opened with the rest of this config.
+	Mounts map[string]string `json:"mounts,omitempty"`
+
+	// A directory of the files table to serve as the root, such as
+	// sites/blog for the rows named sites/blog/*. Default: the whole table.
+	Root string `json:"root,omitempty"`
+
+	// The file system serving names the database has no row for: another
+	// caddy.fs module, or the directory FallbackRoot. Default: none.
+	FallbackRaw  json.RawMessage `json:"fallback,omitempty" caddy:"namespace=caddy.fs inline_key=backend"`
+	FallbackRoot string          `json:"fallback_root,omitempty"`
+
+	// The most databases to keep open when db_path has placeholders only
+	// known for a request, such as {http.vars.tenant}.db, and names a
+	// database for each. Default: 64.
+	MaxDatabases int `json:"max_databases,omitempty"`
+
+	// Limits on requested names: at most MaxDepth path elements and
+	// MaxNameLength bytes. Defaults: 64 and 1024.
+	MaxDepth      int `json:"max_depth,omitempty"`
+	MaxNameLength int `json:"max_name_length,omitempty"`
+
+	// The most entries a single ReadDir or Glob call returns. Default: 10000.
+	MaxListEntries int `json:"max_list_entries,omitempty"`
+
+	// Limits each client's directory listings, globs and searches, so one
+	// crawler can't take all of the database's time.
+	ClientLimit *ClientLimit `json:"client_limit,omitempty"`
+
+	// The sqlite driver, "mattn" (github.com/mattn/go-sqlite3, which needs
+	// cgo) or "modernc" (modernc.org/sqlite, pure Go). Both behave the
+	// same. Default: mattn, or modernc in builds without cgo.
+	Driver string `json:"driver,omitempty"`
+
+	// Lock the database for this Caddy process alone while it runs,
+	// saving the locking work of every query. Only for servers where
+	// nothing else opens the database, not even to write content; queries
+	// then share a single connection.
+	ExclusiveLocking bool `json:"exclusive_locking,omitempty"`
+
+	// Open the database read-only, so nothing writes to it: not writes,
+	// usage tracking or stored integrity hashes. It still sees changes
+	// made by others. Immutable also promises sqlite the file doesn't
+	// change while open, so it takes no locks and needs no -shm file, for
+	// serving from read-only volumes; changes are then only seen after a
+	// reload.
+	ReadOnly  bool `json:"read_only,omitempty"`
+	Immutable bool `json:"immutable,omitempty"`
+
+	// The key of a database encrypted with SQLCipher, such as
+	// {env.DB_KEY}, or the file holding it, such as a mounted secret.
+	// Opening it needs a sqlite with SQLCipher.
+	Key     string `json:"key,omitempty"`
+	KeyFile string `json:"key_file,omitempty"`
+
+	// Pragmas run on each new connection, by name, such as cache_size,
+	// mmap_size, synchronous or busy_timeout (in milliseconds, 5000 by
+	// default).
+	Pragmas map[string]string `json:"pragmas,omitempty"`
+
+	// The most connections to the database open at once, and of those the
+	// most kept open while idle. Defaults: no limit and 2.
+	MaxOpenConns int `json:"max_open_conns,omitempty"`
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+
+	// Content larger than StreamThreshold bytes is read in pieces while it
+	// is served instead of loaded whole, starting with StreamChunkSize
+	// bytes and doubling while reading on. Defaults: 1MiB and 256KiB.
+	StreamThreshold int64 `json:"stream_threshold,omitempty"`
+	StreamChunkSize int64 `json:"stream_chunk_size,omitempty"`
+
+	// Writes of content larger than ChunkSize bytes keep it in the
+	// file_chunks table, in pieces of that size, if the files table has
+	// a chunks column. Default: off.
+	ChunkSize int64 `json:"chunk_size,omitempty"`
+
+	// Keep hot files in memory, so serving them doesn't query the database.
+	MemoryCache *MemoryCache `json:"memory_cache,omitempty"`
+
+	// Warm up caches on Provision, so the first requests don't have to.
+	Warmup *Warmup `json:"warmup,omitempty"`
+
+	// The longest the queries of a lookup, a listing or a piece of
+	// content may take, after which the request fails instead of waiting
+	// on a slow or locked database. Default: no limit.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Check the database this often, reopening it if that fails or the
+	// file was replaced, so rotating it or remounting its volume doesn't
+	// cause a run of failed requests. Default: off.
+	Keepalive caddy.Duration `json:"keepalive,omitempty"`
+
+	// Check the database file this often, and once it was replaced, as
+	// by renaming a new database over it, serve the new file from a fresh
+	// connection pool while requests on the old one finish. Default: off.
+	Watch caddy.Duration `json:"watch,omitempty"`
+
+	// How often background counters are written to the database. Default: 10s.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	logger    *zap.Logger
+	events    *caddyevents.App
+	eventCtx  caddy.Context // of the events emitted
+	db        *sql.DB
+	wdb       *sql.DB // writer handle for bookkeeping and caches
+	hits      *batcher[int64]
+	misses    *batcher[int64]
+	access    *batcher[int64]
+	bandwidth *batcher[int64]
+
+	health         *dbHealth
+	metrics        *instanceMetrics
+	tenantUsage    *usageCache
+	externalClient *http.Client
+	memCache       *memoryCache
+	limiter        *clientLimiter
+
+	readOnly    bool      // opened read-only
+	immutable   bool      // opened immutable, as on a read-only mount
+	key         string    // of an encrypted database
+	provisioned time.Time // modification time of VirtualFiles
+
+	stopKeepalive func()
+	stopPurge     func()
+
+	root     string  // Root without its slashes
+	mounts   []mount // longest prefix first
+	fallback fs.FS   // of names the database has no row for
+	pool     *dbPool // of a per-request or watched db_path
+
+	columns  map[string]bool // of the files table, for optional features
+	aliases  bool            // whether the aliases table exists
+	headers  bool            // whether the headers table exists
+	assets   bool            // whether the assets table exists
+	rendered bool            // whether the rendered table exists
+	dataset  *atomic.Value   // active dataset label
 }
 
 // CaddyModule returns the Caddy module information.
@@ -33,87 +352,850 @@ func (SQLiteFS) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// OpenDB idempotently open database, swallowing failures.
+// OpenDB idempotently opens the database, logging failures. Lookups
+// while it isn't open fail with ErrDatabase.
 func (s *SQLiteFS) OpenDB() {
+	if err := s.openDB(); err != nil && s.logger != nil {
+		s.logger.Error("opening database", zap.String("db_path", s.DBPath), zap.Error(err))
+	}
+}
+
+func (s *SQLiteFS) openDB() error {
 	if s.db != nil {
-		return
+		return nil
 	}
 
-	db, err := sql.Open("sqlite3", s.DBPath+"?_journal=WAL")
+	d := s.sqliteDriver()
+	setup, err := s.connSetup()
+	if err != nil {
+		return err
+	}
+	if s.readOnly {
+		db, err := d.open(s.DBPath, dsnOptions{readOnly: true, immutable: s.immutable}, setup)
+		if err != nil {
+			return err
+		}
+		s.setPoolSize(db)
+		s.db = db
+		return nil
+	}
+	if s.ExclusiveLocking {
+		name, dsn, err := d.source(s.DBPath, dsnOptions{exclusive: true}, setup)
+		if err != nil {
+			return err
+		}
+		db, err := openExclusive(name, dsn)
+		if err != nil {
+			return err
+		}
+		s.db = db
+		return nil
+	}
+	db, err := d.open(s.DBPath, dsnOptions{}, setup)
 	if err != nil {
-		db.Close()
-		s.db = nil
-		return
+		return err
 	}
+	s.setPoolSize(db)
 
 	s.db = db
+	return nil
 }
 
 func (s *SQLiteFS) Provision(ctx caddy.Context) error {
-	s.OpenDB()
-	return nil
+	if err := s.applyDefaults(ctx); err != nil {
+		return err
+	}
+	s.DBPath = caddy.NewReplacer().ReplaceKnown(s.DBPath, "")
+	base := *s
+	logger, err := s.instanceLogger(ctx)
+	if err != nil {
+		return err
+	}
+	s.logger = logger
+	if err := s.provisionEvents(ctx); err != nil {
+		return err
+	}
+	if !perRequestPath(s.DBPath) {
+		// those of a per-request db_path are each database's
+		s.metrics = newInstanceMetrics(s.instanceName())
+	}
+	s.provisioned = time.Now()
+	if len(s.ExternalPrefixes) > 0 {
+		s.externalClient = s.newExternalClient()
+	}
+	if s.root, err = rootPrefix(s.Root); err != nil {
+		return err
+	}
+	if s.UploadPolicy != nil {
+		if err := s.UploadPolicy.provision(); err != nil {
+			return err
+		}
+	}
+	if err := s.provisionFallback(ctx); err != nil {
+		return err
+	}
+	if perRequestPath(s.DBPath) || s.Watch > 0 {
+		s.pool = newDBPool(ctx, base, s.MaxDatabases, s.logger)
+		if s.Watch > 0 {
+			s.pool.startWatch(time.Duration(s.Watch))
+		}
+		if !perRequestPath(s.DBPath) {
+			// opened now, as it is without watch
+			if _, err := s.pool.load(s.DBPath); err != nil {
+				return err
+			}
+		}
+		return s.provisionMounts(ctx, base)
+	}
+	s.readOnly, s.immutable = s.ReadOnly || s.Immutable, s.Immutable
+	if err := s.loadKey(); err != nil {
+		return fmt.Errorf("opening %s: %w", s.DBPath, err)
+	}
+	if err := s.openDB(); err != nil {
+		return fmt.Errorf("opening %s: %w", s.DBPath, err)
+	}
+	if err := s.detectReadOnly(); err != nil {
+		return fmt.Errorf("opening %s read-only: %w", s.DBPath, err)
+	}
+	if s.CreateSchema {
+		if err := s.createSchema(); err != nil {
+			return err
+		}
+	}
+	if err := s.db.Ping(); err != nil {
+		if s.mapsLayout() {
+			// a layout that doesn't fit the table fails every connection
+			return fmt.Errorf("mapping %s: %w", s.DBPath, err)
+		}
+		return fmt.Errorf("opening %s: %w", s.DBPath, err)
+	}
+	s.health = newDBHealth(s.db, s.maxIdleConns(), s.logger.With(zap.String("db_path", s.DBPath)))
+	// a missing table fails Validate
+	s.columns, _ = tableColumns(s.db, "files")
+	s.aliases, _ = tableExists(s.db, "aliases")
+	s.headers, _ = tableExists(s.db, "headers")
+	// the optional table, rather than one of content by that name
+	s.assets, _ = hasColumn(s.db, "assets", "asset")
+	s.rendered, _ = tableExists(s.db, "rendered")
+
+	if s.FlushInterval <= 0 {
+		s.FlushInterval = caddy.Duration(10 * time.Second)
+	}
+	if s.MaxDepth == 0 {
+		s.MaxDepth = 64
+	}
+	if s.MaxNameLength == 0 {
+		s.MaxNameLength = 1024
+	}
+	if s.MaxListEntries == 0 {
+		s.MaxListEntries = 10000
+	}
+	if s.StreamThreshold == 0 {
+		s.StreamThreshold = defaultStreamThreshold
+	}
+	if s.StreamChunkSize == 0 {
+		s.StreamChunkSize = defaultStreamChunkSize
+	}
+	tracking := s.TrackHits || s.TrackAccess || len(s.AccountPrefixes) > 0 || s.AccountTenants
+	if tracking && s.readOnly {
+		return fmt.Errorf("%s is opened read-only, usage tracking needs to write to it", s.DBPath)
+	}
+	if s.PurgeExpired > 0 {
+		if s.readOnly {
+			return fmt.Errorf("%s is opened read-only, purge_expired needs to write to it", s.DBPath)
+		}
+		if !s.columns["expired_at"] {
+			return fmt.Errorf("%s: purge_expired needs an expired_at column in the files table", s.DBPath)
+		}
+	}
+	if s.Compression != "" && !s.columns["compression"] {
+		return fmt.Errorf("%s: compression needs a compression column in the files table", s.DBPath)
+	}
+	if tracking || s.PurgeExpired > 0 || ((s.columns["integrity"] || s.rendered) && !s.readOnly) {
+		if s.ExclusiveLocking {
+			s.wdb = s.db
+		} else {
+			wdb, err := s.sqliteDriver().openWriter(s.DBPath, s.writerSetup())
+			if err != nil {
+				return err
+			}
+			s.wdb = wdb
+		}
+	}
+	if s.TrackHits {
+		if err := s.startHits(s.wdb, s.logger); err != nil {
+			return err
+		}
+		if err := s.startMisses(s.wdb, s.logger); err != nil {
+			return err
+		}
+	}
+	if s.TrackAccess {
+		if err := s.startAccess(s.wdb, s.logger); err != nil {
+			return err
+		}
+	}
+	if len(s.AccountPrefixes) > 0 || s.AccountTenants {
+		if err := s.startBandwidth(s.wdb, s.logger); err != nil {
+			return err
+		}
+	}
+	s.dataset = new(atomic.Value)
+	s.dataset.Store(s.Dataset)
+	if s.TenantQuota != nil {
+		s.tenantUsage = newUsageCache(30 * time.Second)
+	}
+	if s.ClientLimit != nil {
+		s.limiter = newClientLimiter(*s.ClientLimit)
+	}
+	if s.MemoryCache != nil {
+		s.memCache = newMemoryCache(*s.MemoryCache, s.DBPath)
+	}
+	s.warmup()
+	s.startKeepalive()
+	s.startPurge()
+	registerInstance(s)
+	return s.provisionMounts(ctx, base)
 }
 
-func (s SQLiteFS) Cleanup() error {
+func (s *SQLiteFS) Cleanup() error {
+	unregisterInstance(s)
+	for _, m := range s.mounts {
+		m.fsys.Cleanup()
+	}
+	if s.pool != nil {
+		s.pool.close()
+	}
+	if s.health != nil {
+		s.health.close()
+	}
+	if s.stopKeepalive != nil {
+		s.stopKeepalive()
+	}
+	if s.stopPurge != nil {
+		s.stopPurge()
+	}
+	if s.misses != nil {
+		s.misses.close()
+	}
+	if s.hits != nil {
+		s.hits.close()
+	}
+	if s.access != nil {
+		s.access.close()
+	}
+	if s.bandwidth != nil {
+		s.bandwidth.close()
+	}
+	if s.wdb != nil && s.wdb != s.db {
+		s.wdb.Close()
+	}
 	if s.db != nil {
+		if s.ExclusiveLocking && !s.readOnly {
+			return closeExclusive(s.db)
+		}
 		return s.db.Close()
 	}
 	return nil
 }
 
-// Validate stub since Open() handles errors by returning fs.ErrNotExist
+// Validate checks the configuration, and that the database Provision opened
+// exists and has a files table; later database errors are returned as
+// ErrDatabase.
 func (s *SQLiteFS) Validate() error {
+	switch s.Expired {
+	case "", "not_found", "gone", "stale":
+	default:
+		return fmt.Errorf("unknown expired behavior %q", s.Expired)
+	}
+	switch s.ContentEncoding {
+	case "", "raw", "base64":
+	default:
+		return fmt.Errorf("unknown content encoding %q", s.ContentEncoding)
+	}
+	if s.Compression != "" && !validCompression(s.Compression) {
+		return fmt.Errorf("unknown compression %q", s.Compression)
+	}
+	switch s.UnicodeNormalization {
+	case "", "nfc", "nfd":
+	default:
+		return fmt.Errorf("unknown unicode normalization %q", s.UnicodeNormalization)
+	}
+	if s.TenantQuota != nil && s.TenantColumn == "" {
+		return errors.New("tenant_quota requires tenant_column")
+	}
+	if s.AccountTenants && s.TenantColumn == "" {
+		return errors.New("account_tenants requires tenant_column")
+	}
+	switch s.QuotaExceeded {
+	case "", "reject", "evict_oldest":
+	default:
+		return fmt.Errorf("unknown quota_exceeded behavior %q", s.QuotaExceeded)
+	}
+	for _, state := range s.PermissionDenied {
+		switch state {
+		case "private", "quota_exceeded", "tenant_mismatch":
+		default:
+			return fmt.Errorf("unknown permission_denied state %q", state)
+		}
+	}
+	if _, err := parseDriver(s.Driver); err != nil {
+		return err
+	}
+	if s.Collation != nil {
+		if _, err := s.Collation.collator(); err != nil {
+			return err
+		}
+	}
+	if s.Query != "" && (s.Table != "" || len(s.layoutMapping()) > 0) {
+		return errors.New("query replaces table and the column options, set one or the others")
+	}
+	if s.mapsLayout() && s.CreateSchema {
+		return errors.New("create_schema creates a files table, which table and query replace")
+	}
+	if s.mapsLayout() && s.TrackAccess {
+		return errors.New("track_access writes to the files table, which table and query replace")
+	}
+	if s.mapsLayout() && s.PurgeExpired > 0 {
+		return errors.New("purge_expired deletes from the files table, which table and query replace")
+	}
+	if l := s.ClientLimit; l != nil && (l.MaxConcurrent < 0 || l.Rate < 0 || l.Burst < 0) {
+		return errors.New("client_limit values must not be negative")
+	}
+	for name := range s.VirtualFiles {
+		if !fs.ValidPath(name) || name == "." {
+			return fmt.Errorf("virtual file name %q must be a relative path without a leading slash", name)
+		}
+	}
+	if _, err := rootPrefix(s.Root); err != nil {
+		return err
+	}
+	for prefix := range s.Mounts {
+		if _, err := mountPrefix(prefix); err != nil {
+			return err
+		}
+	}
+	for _, m := range s.mounts {
+		if err := m.fsys.Validate(); err != nil {
+			return fmt.Errorf("mount %s: %w", m.prefix, err)
+		}
+	}
+	if s.db != nil {
+		return s.checkDatabase()
+	}
 	return nil
 }
 
+// ErrDatabase is matched by the errors of lookups that failed in the
+// database, such as on a corrupt or unreadable file, rather than finding
+// nothing, so they are served as server errors instead of 404s.
+var ErrDatabase = errors.New("database error")
+
+// errNotOpen is the ErrDatabase of lookups while the database isn't open.
+var errNotOpen = errors.New("database not open")
+
+// dbError logs the failed query of the lookup of name and returns it as an
+// ErrDatabase, and has the database checked before the next lookups.
+// Queries cut short by the end of their request aren't logged, and like
+// those that timed out say nothing about the database.
+func (s SQLiteFS) dbError(op, name string, err error) error {
+	if !errors.Is(err, context.Canceled) {
+		s.logger.Error("database query failed",
+			zap.String("op", op),
+			zap.String("name", name),
+			zap.String("db_path", s.DBPath),
+			zap.Error(err))
+		s.emit("db_error", map[string]any{"op": op, "name": name, "error": err.Error()})
+	}
+	if s.health != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		s.health.failed(err)
+	}
+	return fmt.Errorf("%w: %w", ErrDatabase, err)
+}
+
+// ErrGone is returned for files that exist but expired, when configured
+// with "expired": "gone". It matches fs.ErrNotExist for callers unaware of it.
+var ErrGone error = goneError{}
+
+type goneError struct{}
+
+func (goneError) Error() string        { return "file expired" }
+func (goneError) Is(target error) bool { return target == fs.ErrNotExist }
+
 // Open implements fs.FS.
 func (s SQLiteFS) Open(name string) (fs.File, error) {
-	s.OpenDB()
-	if s.db == nil {
+	return s.OpenContext(context.Background(), name)
+}
+
+// OpenContext opens name for the request ctx belongs to, if any, so
+// per-request placeholders in the config can be resolved.
+func (s SQLiteFS) OpenContext(ctx context.Context, name string) (fs.File, error) {
+	if s.fallback != nil {
+		f, err := s.primary().OpenContext(ctx, name)
+		if s.fallsBack(err) {
+			return s.fallbackOpen(ctx, name)
+		}
+		return f, err
+	}
+	if m, rest := s.mounted(name); m != nil {
+		f, err := m.fsys.OpenContext(ctx, rest)
+		if err != nil {
+			return nil, err
+		}
+		return m.file(f), nil
+	}
+	if s.pool != nil {
+		fsys, err := s.pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return fsys.OpenContext(ctx, name)
+	}
+	name = s.normalizeName(name)
+	if f, ok := s.openVirtual(name); ok {
+		s.metrics.opened(nil)
+		return f, nil
+	}
+	if err := s.usable(); err != nil {
+		s.metrics.opened(err)
+		return nil, err
+	}
+	stored := s.rootName(name)
+	f, err := s.openFile(ctx, stored, 0)
+	if errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrGone) {
+		if d, ok := s.impliedDir(ctx, stored); ok {
+			s.metrics.opened(nil)
+			return s.rootFile(d), nil
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrGone) && s.nameAllowed(stored) {
+		if s.misses != nil {
+			s.misses.add(stored, 1)
+		}
+		s.emit("miss", map[string]any{"name": stored})
+	}
+	s.metrics.opened(err)
+	return s.rootFile(f), err
+}
+
+// Stat implements fs.StatFS.
+func (s SQLiteFS) Stat(name string) (fs.FileInfo, error) {
+	return s.StatContext(context.Background(), name)
+}
+
+// StatContext returns the FileInfo of name like OpenContext, selecting
+// the length of the content but never the content itself, so HEAD
+// requests and try_files probes stay cheap. Unlike opens, names it doesn't
+// find aren't counted as misses.
+func (s SQLiteFS) StatContext(ctx context.Context, name string) (fs.FileInfo, error) {
+	if s.fallback != nil {
+		info, err := s.primary().StatContext(ctx, name)
+		if s.fallsBack(err) {
+			return s.fallbackStat(ctx, name)
+		}
+		return info, err
+	}
+	if m, rest := s.mounted(name); m != nil {
+		if rest == "." {
+			// the root of the mount, by the name it has here
+			return sqliteFileInfo{name: name, mode: fs.ModeDir | 0o555, modTime: s.provisioned}, nil
+		}
+		info, err := m.fsys.StatContext(ctx, rest)
+		if fi, ok := info.(sqliteFileInfo); ok {
+			return m.info(fi), nil
+		}
+		return info, err
+	}
+	if s.pool != nil {
+		fsys, err := s.pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return fsys.StatContext(ctx, name)
+	}
+	info, err := s.statContext(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrGone) {
+		if d, ok := s.impliedDirInfo(ctx, s.rootName(s.normalizeName(name))); ok {
+			return s.rootInfo(d), nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// openFile opens name, following aliases and symlinks that are hops deep
+// so far.
+func (s SQLiteFS) openFile(ctx context.Context, name string, hops int) (fs.File, error) {
+	if !s.nameAllowed(name) {
 		return nil, fs.ErrNotExist
 	}
+	row, err := s.lookupCached(ctx, name, hops, true)
+	if err != nil {
+		return nil, err
+	}
+	if row.info.mode&fs.ModeSymlink != 0 {
+		target, ok := s.followLink(row.info.name, string(row.content))
+		if !ok || row.hops >= maxAliasHops {
+			return nil, fs.ErrNotExist
+		}
+		return s.openFile(ctx, target, row.hops+1)
+	}
+	name = row.info.name
+	if row.info.IsDir() {
+		return &sqliteDir{fsys: s, ctx: ctx, info: row.info}, nil
+	}
+	if row.info.stale {
+		s.emit("expired_served", map[string]any{"name": name, "expired_at": row.expiresAt.Unix()})
+	}
+
+	f := &sqliteFile{info: row.info, compressed: row.compressed}
+	if row.chunked() {
+		f.reader = s.openChunks(ctx, *row.chunks, row.info.size)
+	} else if row.content != nil {
+		f.reader = bytes.NewReader(row.content)
+	} else if s.StreamThreshold > 0 && row.info.size > s.StreamThreshold {
+		if f.reader, err = s.openSubstr(ctx, name, row.key, row.info.size); err != nil {
+			return nil, err
+		}
+	} else {
+		f.load = func() ([]byte, error) { return s.loadContent(ctx, name, row.key) }
+	}
+	if row.external != nil && *row.external != "" {
+		rc, size, modTime, err := s.openExternal(ctx, *row.external)
+		if err != nil {
+			return nil, err
+		}
+		f.reader, f.closer = rc, rc
+		f.info.size = size
+		if f.info.modTime.IsZero() {
+			f.info.modTime = modTime
+		}
+	}
+	if s.hits != nil {
+		s.hits.add(name, 1)
+	}
+	if s.access != nil {
+		s.access.add(name, time.Now().Unix())
+	}
+	if s.bandwidth != nil {
+		if keys := s.accountingKeys(ctx, name); len(keys) > 0 {
+			f.onClose = func(read int64) {
+				for _, key := range keys {
+					s.bandwidth.add(key, read)
+				}
+			}
+		}
+	}
+	if row.limited {
+		// Stat-only opens don't count; the first read claims a download
+		f.onFirstRead = func() error { return s.claimDownload(ctx, name, row.key, row.filter, row.args) }
+	}
+
+	return f, nil
+}
+
+// statContext returns the FileInfo of name like OpenContext, but without
+// counting it as opened.
+func (s SQLiteFS) statContext(ctx context.Context, name string) (sqliteFileInfo, error) {
+	if m, rest := s.mounted(name); m != nil {
+		info, err := m.fsys.statContext(ctx, rest)
+		if err != nil {
+			return info, err
+		}
+		return m.info(info), nil
+	}
+	if s.pool != nil {
+		fsys, err := s.pool.get(ctx)
+		if err != nil {
+			return sqliteFileInfo{}, err
+		}
+		return fsys.statContext(ctx, name)
+	}
+	name = s.normalizeName(name)
+	if f, ok := s.openVirtual(name); ok {
+		return f.(*sqliteFile).info, nil
+	}
+	if err := s.usable(); err != nil {
+		return sqliteFileInfo{}, err
+	}
+	info, err := s.statFile(ctx, s.rootName(name), 0)
+	return s.rootInfo(info), err
+}
+
+func (s SQLiteFS) statFile(ctx context.Context, name string, hops int) (sqliteFileInfo, error) {
+	if !s.nameAllowed(name) {
+		return sqliteFileInfo{}, fs.ErrNotExist
+	}
+	row, err := s.lookupCached(ctx, name, hops, false)
+	if err != nil {
+		return sqliteFileInfo{}, err
+	}
+	if row.info.mode&fs.ModeSymlink != 0 {
+		target, ok := s.followLink(row.info.name, string(row.content))
+		if !ok || row.hops >= maxAliasHops {
+			return sqliteFileInfo{}, fs.ErrNotExist
+		}
+		return s.statFile(ctx, target, row.hops+1)
+	}
+	if row.external != nil && *row.external != "" {
+		rc, size, modTime, err := s.openExternal(ctx, *row.external)
+		if err != nil {
+			return sqliteFileInfo{}, err
+		}
+		rc.Close()
+		row.info.size = size
+		if row.info.modTime.IsZero() {
+			row.info.modTime = modTime
+		}
+	}
+	return row.info, nil
+}
 
-	row := s.db.QueryRow("SELECT content, modified, mode FROM files WHERE name=? AND (expired_at IS NULL OR expired_at > strftime('%s','now')) LIMIT 1", name)
+// fileRow is the row a lookup selected.
+type fileRow struct {
+	content  []byte // nil until loaded, except for symlinks and encoded content
+	info     sqliteFileInfo
+	key      rowKey
+	hops     int     // aliases followed to get here
+	external *string // location of content kept outside the database
+	limited  bool    // whether it has a number of downloads left
+	chunks   *string // id of the pieces of content kept in file_chunks
 
-	var content []byte
-	var modified *int64
-	var mode *int32
-	err := row.Scan(&content, &modified, &mode)
+	compressed []byte // content as stored, if it is compressed
+
+	expiresAt time.Time // when it expires, if selected and it does
+
+	// the visibility conditions the row was selected with
+	filter string
+	args   []any
+}
+
+// chunked reports whether the content of row is kept in file_chunks.
+func (row *fileRow) chunked() bool {
+	return row.chunks != nil && *row.chunks != ""
+}
+
+// lookup selects the row to serve for name, following aliases but not
+// symlinks.
+func (s SQLiteFS) lookup(ctx context.Context, name string, hops int) (*fileRow, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+	filter, args, ok := s.rowFilter(ctx)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	row := &fileRow{filter: filter, args: args, hops: hops}
+	var size, modified *int64
+	var mode *int64 // fs.ModeDir doesn't fit an int32
+	// only the length for now, so opening a file to Stat it stays cheap
+	cols, dest := s.sizeColumn()+", modified, mode", []any{&size, &modified, &mode}
+	row.key.variantColumn = s.columns["variant"]
+	if s.columns["version"] {
+		cols, dest = cols+", version", append(dest, &row.key.version)
+	}
+	if s.columns["variant"] {
+		cols, dest = cols+", variant", append(dest, &row.key.variant)
+	}
+	var expiredAt *int64
+	if s.Expired == "stale" || s.memCache != nil {
+		cols, dest = cols+", expired_at", append(dest, &expiredAt)
+	}
+	var canonical *string
+	if s.columns["canonical"] {
+		cols, dest = cols+", canonical", append(dest, &canonical)
+	}
+	if s.columns["external"] {
+		cols, dest = cols+", external", append(dest, &row.external)
+	}
+	if s.columns["max_downloads"] {
+		cols, dest = cols+", max_downloads IS NOT NULL", append(dest, &row.limited)
+	}
+	if s.columns["chunks"] {
+		cols, dest = cols+", chunks", append(dest, &row.chunks)
+	}
+	var encoding *string
+	if s.columns["encoding"] {
+		cols, dest = cols+", encoding", append(dest, &encoding)
+	}
+	var compression *string
+	if s.columns["compression"] {
+		cols, dest = cols+", compression", append(dest, &compression)
+	}
+	var contentType *string
+	if s.columns["content_type"] {
+		cols, dest = cols+", content_type", append(dest, &contentType)
+	}
+	var hash, tag *string
+	if s.columns["integrity"] {
+		cols, dest = cols+", integrity", append(dest, &hash)
+	}
+	if s.columns["etag"] {
+		cols, dest = cols+", etag", append(dest, &tag)
+	}
+	order, orderArgs := s.latestFirst(ctx)
+	start := time.Now()
+	err := s.db.QueryRowContext(ctx, "SELECT "+cols+" FROM files WHERE name=? AND "+filter+order+" LIMIT 1", append(append([]any{name}, args...), orderArgs...)...).Scan(dest...)
+	s.metrics.queried("lookup", start)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, s.dbError("open", name, err)
+	}
 	if err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			// database error, invalidate it for next hit
-			s.db = nil
+		if s.Expired == "gone" && s.expiredExists(ctx, name) {
+			s.emit("expired_denied", map[string]any{"name": name})
+			return nil, ErrGone
+		} else if len(s.PermissionDenied) > 0 && s.restricted(ctx, name) {
+			return nil, fs.ErrPermission
+		} else if target, ok := s.resolveAlias(ctx, name, hops); ok {
+			return s.canonicalLookup(ctx, target, hops+1)
+		} else if target, ok := s.resolveCase(ctx, name, hops, filter, args); ok {
+			return s.canonicalLookup(ctx, target, hops+1)
 		}
 		return nil, fs.ErrNotExist
 	}
 
-	f := &sqliteFile{
-		reader: bytes.NewBuffer(content),
-		info: sqliteFileInfo{
-			size: int64(len(content)),
-		},
+	row.info = sqliteFileInfo{name: name}
+	if size != nil {
+		row.info.size = *size
 	}
 	if modified != nil {
-		f.info.modTime = time.Unix(*modified, 0)
+		row.info.modTime = time.Unix(*modified, 0)
 	}
 	if mode != nil {
-		f.info.mode = fs.FileMode(*mode)
+		row.info.mode = fs.FileMode(*mode)
+	}
+	enc := s.ContentEncoding
+	if encoding != nil && *encoding != "" {
+		enc = *encoding
+	}
+	compressed := compression != nil && *compression != ""
+	if ((enc != "" && enc != "raw") || compressed || row.info.mode&fs.ModeSymlink != 0) && !row.chunked() {
+		// the size or the link target needs the content itself
+		content, err := s.loadContent(ctx, name, row.key)
+		if err != nil {
+			return nil, err
+		}
+		if row.content, err = decodeContent(enc, content); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if compressed {
+			row.compressed, row.info.compression = row.content, *compression
+			if row.content, err = decompress(*compression, row.compressed); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		row.info.size = int64(len(row.content))
+	}
+	if expiredAt != nil {
+		row.expiresAt = time.Unix(*expiredAt, 0)
+		row.info.stale = s.Expired == "stale" && *expiredAt <= time.Now().Unix()
 	}
+	if canonical != nil && *canonical != name {
+		row.info.canonical = *canonical
+	}
+	if hash != nil {
+		row.info.hash = *hash
+	}
+	if tag != nil {
+		row.info.tag = storedETag(*tag)
+	}
+	if contentType != nil {
+		row.info.contentType = *contentType
+	}
+	if row.key.variant != nil {
+		row.info.variant = *row.key.variant
+	}
+	return row, nil
+}
 
-	return f, nil
+// queryContext bounds the queries made with ctx by Timeout.
+func (s SQLiteFS) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Duration(s.Timeout))
 }
 
 type sqliteFile struct {
-	reader *bytes.Buffer
+	reader io.ReadSeeker // nil until load has run
+	load   func() ([]byte, error)
+	offset int64     // sought to before loading
+	closer io.Closer // of external content
 	info   sqliteFileInfo
+
+	compressed []byte // content as stored, if compressed
+
+	read        int64
+	onClose     func(read int64)
+	onFirstRead func() error
 }
 
 func (f sqliteFile) Stat() (fs.FileInfo, error) { return f.info, nil }
-func (f sqliteFile) Read(p []byte) (int, error) { return f.reader.Read(p) }
+func (f *sqliteFile) Read(p []byte) (int, error) {
+	if fn := f.onFirstRead; fn != nil {
+		f.onFirstRead = nil
+		if err := fn(); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.loadContent(); err != nil {
+		return 0, err
+	}
+	n, err := f.reader.Read(p)
+	f.read += int64(n)
+	return n, err
+}
+func (f *sqliteFile) Seek(offset int64, whence int) (int64, error) {
+	if f.reader != nil {
+		return f.reader.Seek(offset, whence)
+	}
+	// ServeContent seeks to learn the size; that doesn't need the content
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("sqliteFile.Seek: negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// loadContent fetches the content on first use.
+func (f *sqliteFile) loadContent() error {
+	if f.reader != nil {
+		return nil
+	}
+	if f.load == nil {
+		return fs.ErrClosed
+	}
+	content, err := f.load()
+	if err != nil {
+		return err
+	}
+	r := bytes.NewReader(content)
+	if _, err := r.Seek(f.offset, io.SeekStart); err != nil {
+		return err
+	}
+	f.reader, f.load = r, nil
+	return nil
+}
 func (f *sqliteFile) Close() error {
-	f.reader = nil
+	if f.onClose != nil {
+		f.onClose(f.read)
+		f.onClose = nil
+	}
+	var err error
+	if f.closer != nil {
+		err = f.closer.Close()
+		f.closer = nil
+	}
+	f.reader, f.load = nil, nil
 	f.info = sqliteFileInfo{}
-	return nil
+	return err
 }
 
 type sqliteFileInfo struct {
@@ -121,6 +1203,16 @@ type sqliteFileInfo struct {
 	size    int64
 	modTime time.Time
 	mode    fs.FileMode
+	stale   bool   // expired but within the stale grace period
+	hash    string // stored hash of the content, for ETags
+	tag     string // stored entity tag, quoted
+	variant string // of the row, if not the fallback
+
+	compression string // of the stored content, if compressed
+	contentType string // stored media type of the content
+
+	// the name this file should be requested by, if not the one used
+	canonical string
 }
 
 func (fi sqliteFileInfo) Name() string       { return path.Base(fi.name) }
@@ -128,13 +1220,40 @@ func (fi sqliteFileInfo) Size() int64        { return fi.size }
 func (fi sqliteFileInfo) Mode() fs.FileMode  { return fi.mode }
 func (fi sqliteFileInfo) ModTime() time.Time { return fi.modTime }
 func (fi sqliteFileInfo) IsDir() bool        { return fi.mode.IsDir() }
-func (fi sqliteFileInfo) Sys() any           { return nil }
+
+// Sys returns the *FileMetadata of files with any, or nil.
+func (fi sqliteFileInfo) Sys() any {
+	if fi.contentType == "" {
+		return nil
+	}
+	return &FileMetadata{ContentType: fi.contentType}
+}
+
+// FileMetadata is what the FileInfo of a file returns from Sys when its
+// row has more than a FileInfo tells, for handlers other than
+// sqlite_file_server, which uses it itself.
+type FileMetadata struct {
+	// Of the content_type column, to serve the content as instead of the
+	// type of its extension or of its first bytes.
+	ContentType string
+}
 
 // Interface guards
 var (
 	_ caddy.Provisioner     = (*SQLiteFS)(nil)
 	_ caddy.CleanerUpper    = (*SQLiteFS)(nil)
 	_ fs.FS                 = (*SQLiteFS)(nil)
+	_ fs.ReadDirFS          = (*SQLiteFS)(nil)
+	_ fs.StatFS             = (*SQLiteFS)(nil)
+	_ fs.GlobFS             = (*SQLiteFS)(nil)
+	_ fs.SubFS              = (*SQLiteFS)(nil)
 	_ caddyfile.Unmarshaler = (*SQLiteFS)(nil)
 	_ caddy.Validator       = (*SQLiteFS)(nil)
+
+	// fs.ReadLinkFS of Go 1.25, newer than go.mod
+	_ interface {
+		fs.FS
+		ReadLink(name string) (string, error)
+		Lstat(name string) (fs.FileInfo, error)
+	} = (*SQLiteFS)(nil)
 )
@@ -0,0 +1,39 @@
+package sqlitefs
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// newTestFS provisions s for a new database with the full schema, after
+// running setup on it.
+func newTestFS(t *testing.T, s SQLiteFS, setup ...string) SQLiteFS {
+	t.Helper()
+	s.DBPath = filepath.Join(t.TempDir(), "test.db")
+	db, err := openSQLite(s.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range append([]string{schema}, setup...) {
+		if _, err := db.Exec(q); err != nil {
+			db.Close()
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	db.Close()
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Cleanup() })
+	return s
+}
+
+// mustExec runs q on the database of s.
+func mustExec(t *testing.T, s SQLiteFS, q string, args ...any) {
+	t.Helper()
+	if _, err := s.db.Exec(q, args...); err != nil {
+		t.Fatalf("%s: %v", q, err)
+	}
+}
@@ -0,0 +1,95 @@
+package sqlitefs
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Mounts serve other databases below prefixes of the file system, each
+// through a file system configured like this one but for its own
+// database. Names below a prefix never reach the database of db_path, and
+// the prefixes show up as directories in listings.
+
+// mount is a database served below prefix.
+type mount struct {
+	prefix string // without slashes
+	fsys   *SQLiteFS
+}
+
+// mountPrefix returns prefix of the mounts option without its slashes.
+func mountPrefix(prefix string) (string, error) {
+	p := strings.Trim(prefix, "/")
+	if !fs.ValidPath(p) || p == "." {
+		return "", fmt.Errorf("mount prefix %q must be a path below the root", prefix)
+	}
+	return p, nil
+}
+
+// provisionMounts provisions a file system for each of Mounts with the
+// config of base, longest prefix first so nested mounts take precedence.
+func (s *SQLiteFS) provisionMounts(ctx caddy.Context, base SQLiteFS) error {
+	for prefix, dbPath := range s.Mounts {
+		p, err := mountPrefix(prefix)
+		if err != nil {
+			return err
+		}
+		m := base
+		// named after its database, and without what only the root serves
+		m.DBPath, m.Name, m.Mounts, m.VirtualFiles = dbPath, "", nil, nil
+		m.FallbackRaw, m.FallbackRoot, m.Root = nil, "", ""
+		if err := m.Provision(ctx); err != nil {
+			return fmt.Errorf("mount %s: %w", p, err)
+		}
+		s.mounts = append(s.mounts, mount{prefix: p, fsys: &m})
+	}
+	sort.Slice(s.mounts, func(i, j int) bool { return len(s.mounts[i].prefix) > len(s.mounts[j].prefix) })
+	return nil
+}
+
+// mounted returns the mount name is below and the name within it, or nil
+// if name isn't below one.
+func (s SQLiteFS) mounted(name string) (*mount, string) {
+	for i, m := range s.mounts {
+		if name == m.prefix {
+			return &s.mounts[i], "."
+		}
+		if rest, ok := strings.CutPrefix(name, m.prefix+"/"); ok {
+			return &s.mounts[i], rest
+		}
+	}
+	return nil, name
+}
+
+// info returns fi with the names it has in the file system m is mounted
+// in, so headers, redirects and precompressed copies are found by them.
+func (m *mount) info(fi sqliteFileInfo) sqliteFileInfo {
+	fi.name = path.Join(m.prefix, fi.name)
+	if fi.canonical != "" {
+		fi.canonical = path.Join(m.prefix, strings.TrimPrefix(fi.canonical, "/"))
+	}
+	return fi
+}
+
+// file is f with the names of info. Directories keep theirs, which they
+// are listed by.
+func (m *mount) file(f fs.File) fs.File {
+	if sf, ok := f.(*sqliteFile); ok {
+		sf.info = m.info(sf.info)
+	}
+	return f
+}
+
+// mountsBelow calls fn with the prefix of each mount below prefix, a
+// directory name with a trailing slash or "" for the root.
+func (s SQLiteFS) mountsBelow(prefix string, fn func(string)) {
+	for _, m := range s.mounts {
+		if strings.HasPrefix(m.prefix, prefix) {
+			fn(m.prefix)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package sqlitefs
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeName rewrites a requested name into the form the database stores
+// names in, according to PercentDecode and UnicodeNormalization.
+func (s SQLiteFS) normalizeName(name string) string {
+	if s.PercentDecode {
+		if decoded, err := url.PathUnescape(name); err == nil {
+			name = decoded
+		}
+	}
+	switch s.UnicodeNormalization {
+	case "nfc":
+		name = norm.NFC.String(name)
+	case "nfd":
+		name = norm.NFD.String(name)
+	}
+	return name
+}
+
+// nameAllowed reports whether name is within MaxNameLength and MaxDepth.
+// Longer or deeper names are reported as not existing without a query.
+func (s SQLiteFS) nameAllowed(name string) bool {
+	if s.MaxNameLength > 0 && len(name) > s.MaxNameLength {
+		return false
+	}
+	return s.MaxDepth <= 0 || strings.Count(name, "/")+1 <= s.MaxDepth
+}
@@ -0,0 +1,62 @@
+package sqlitefs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
+	"go.uber.org/zap"
+)
+
+// Precompressed copies of a file are stored next to it under its name with
+// the suffix of their encoding, app.js.br for app.js, as file_server's
+// precompressed option expects them on disk. Listings show them like any
+// other file.
+
+// precompressedSuffixes are the name suffixes of the encodings copies can
+// be stored in.
+var precompressedSuffixes = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+// defaultPrecompressed is the order encodings are preferred in when the
+// precompressed option names none, smallest first.
+var defaultPrecompressed = []string{"br", "zstd", "gzip"}
+
+func validatePrecompressed(encodings []string) error {
+	for _, enc := range encodings {
+		if _, ok := precompressedSuffixes[enc]; !ok {
+			return fmt.Errorf("unknown precompressed encoding %q", enc)
+		}
+	}
+	return nil
+}
+
+// openPrecompressed opens the stored copy of name in the encoding r accepts
+// best, returning the encoding, or a nil file if there is none.
+func (fsrv *FileServer) openPrecompressed(r *http.Request, name string) (string, fs.File, fs.FileInfo) {
+	for _, enc := range encode.AcceptedEncodings(r, fsrv.Precompressed) {
+		if !slices.Contains(fsrv.Precompressed, enc) {
+			continue
+		}
+		f, err := fsrv.fsys.OpenContext(r.Context(), name+precompressedSuffixes[enc])
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				fsrv.fsys.logger.Warn("opening precompressed file", zap.String("name", name), zap.String("encoding", enc), zap.Error(err))
+			}
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			f.Close()
+			continue
+		}
+		return enc, f, info
+	}
+	return "", nil, nil
+}
@@ -0,0 +1,112 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrPreconditionFailed is returned by writes whose If-Match doesn't
+	// match the file as stored, because someone else changed it since.
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	// ErrPreconditionRequired is returned by writes without If-Match when
+	// RequireIfMatch is set.
+	ErrPreconditionRequired = errors.New("precondition required")
+)
+
+// checkIfMatch returns ErrPreconditionFailed unless the If-Match header
+// value ifMatch matches the current row of name: its ETag or, in a files
+// table with a version column, its version number as a quoted string such
+// as "3". "*" matches any existing row. Write paths call it in the
+// transaction that changes the row, so concurrent edits can't interleave.
+func (s SQLiteFS) checkIfMatch(ctx context.Context, tx *sql.Tx, name, ifMatch string) error {
+	if ifMatch == "" {
+		if s.RequireIfMatch {
+			return fmt.Errorf("writing %s: %w", name, ErrPreconditionRequired)
+		}
+		return nil
+	}
+	scope, args, ok := s.scopeFilter(ctx)
+	if !ok {
+		return fmt.Errorf("writing %s: %w", name, ErrPreconditionFailed)
+	}
+	var size, modified *int64
+	var hash, tag *string
+	var version *int64
+	cols, dest := s.sizeColumn()+", modified", []any{&size, &modified}
+	if s.columns["integrity"] {
+		cols, dest = cols+", integrity", append(dest, &hash)
+	}
+	if s.columns["etag"] {
+		cols, dest = cols+", etag", append(dest, &tag)
+	}
+	if s.columns["version"] {
+		cols, dest = cols+", version", append(dest, &version)
+	}
+	// as in lookup, the size of encoded or compressed content is that of
+	// the content served
+	var content []byte
+	var encoding, compression, chunks *string
+	if s.ContentEncoding != "" || s.columns["encoding"] || s.columns["compression"] {
+		cols, dest = cols+", content", append(dest, &content)
+	}
+	if s.columns["encoding"] {
+		cols, dest = cols+", encoding", append(dest, &encoding)
+	}
+	if s.columns["compression"] {
+		cols, dest = cols+", compression", append(dest, &compression)
+	}
+	if s.columns["chunks"] {
+		cols, dest = cols+", chunks", append(dest, &chunks)
+	}
+	order, orderArgs := s.latestFirst(ctx)
+	err := tx.QueryRowContext(ctx, "SELECT "+cols+" FROM files WHERE name=? AND "+scope+order+" LIMIT 1", append(append([]any{name}, args...), orderArgs...)...).Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		// not even "*" matches a missing file
+		return fmt.Errorf("writing %s: %w", name, ErrPreconditionFailed)
+	}
+	if err != nil {
+		return err
+	}
+
+	var fi sqliteFileInfo
+	if size != nil {
+		fi.size = *size
+	}
+	if modified != nil {
+		fi.modTime = time.Unix(*modified, 0)
+	}
+	enc := s.ContentEncoding
+	if encoding != nil && *encoding != "" {
+		enc = *encoding
+	}
+	compressed := compression != nil && *compression != ""
+	if ((enc != "" && enc != "raw") || compressed) && (chunks == nil || *chunks == "") {
+		if content, err = decodeContent(enc, content); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if compressed {
+			if content, err = decompress(*compression, content); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		fi.size = int64(len(content))
+	}
+	if hash != nil {
+		fi.hash = *hash
+	}
+	if tag != nil {
+		fi.tag = storedETag(*tag)
+	}
+	if etagListMatches(ifMatch, fi.etag(), false) {
+		return nil
+	}
+	if version != nil && etagListMatches(ifMatch, versionTag(*version), false) {
+		return nil
+	}
+	return fmt.Errorf("writing %s: %w", name, ErrPreconditionFailed)
+}
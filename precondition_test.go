@@ -0,0 +1,52 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// filesWithout is a files table of only the columns that keep the ETag
+// computed from the size and modification time.
+const filesWithout = `DROP TABLE files;
+CREATE TABLE files (name TEXT PRIMARY KEY, content BLOB, modified INTEGER, mode INTEGER,
+	expired_at INTEGER, compression TEXT, chunks TEXT)`
+
+func TestIfMatchRoundTrip(t *testing.T) {
+	content := bytes.Repeat([]byte("hello, world\n"), 20)
+	for _, tc := range []struct {
+		name string
+		fs   SQLiteFS
+	}{
+		{"plain", SQLiteFS{}},
+		{"compressed", SQLiteFS{Compression: "gzip"}},
+		{"base64", SQLiteFS{ContentEncoding: "base64"}},
+		{"chunked", SQLiteFS{ChunkSize: 16}},
+		{"compressed below chunk_size", SQLiteFS{Compression: "gzip", ChunkSize: 1 << 10}},
+		{"chunked, not compressed", SQLiteFS{Compression: "gzip", ChunkSize: 16}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestFS(t, tc.fs, filesWithout)
+			ctx := context.Background()
+			tag, err := s.WriteFileContext(ctx, "a.txt", content, WriteOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fi, err := s.Stat("a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fi.(sqliteFileInfo).etag(); got != tag {
+				t.Fatalf("served ETag %s, write returned %s", got, tag)
+			}
+			if _, err := s.WriteFileContext(ctx, "a.txt", content, WriteOptions{IfMatch: tag}); err != nil {
+				t.Fatalf("writing with If-Match: %s: %v", tag, err)
+			}
+			_, err = s.WriteFileContext(ctx, "a.txt", content, WriteOptions{IfMatch: `"stale"`})
+			if !errors.Is(err, ErrPreconditionFailed) {
+				t.Fatalf("writing with a stale If-Match: got %v, want ErrPreconditionFailed", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// maxPrefetch bounds the assets prefetched for one page.
+const maxPrefetch = 64
+
+// Prefetch loads the local assets the page name references, so they are in
+// cache when the browser asks for them: into the memory cache if there is
+// one, otherwise in one query into sqlite's. The references come from the
+// assets table, or from parsing the page if it has no rows there.
+func (s SQLiteFS) Prefetch(ctx context.Context, name string) error {
+	if m, rest := s.mounted(name); m != nil {
+		return m.fsys.Prefetch(ctx, rest)
+	}
+	if s.pool != nil {
+		fsys, err := s.pool.get(ctx)
+		if err != nil {
+			return err
+		}
+		return fsys.Prefetch(ctx, name)
+	}
+	filter, args, ok := s.rowFilter(ctx)
+	if !ok {
+		return nil
+	}
+	assets, err := s.pageAssets(ctx, s.rootName(name))
+	if err != nil || len(assets) == 0 {
+		return err
+	}
+	if s.memCache != nil {
+		// into memory, where the requests for them look first
+		for _, asset := range assets {
+			if _, err := s.lookupCached(ctx, asset, 0, true); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(assets)), ",")
+	queryArgs := make([]any, 0, len(assets)+len(args))
+	for _, a := range assets {
+		queryArgs = append(queryArgs, a)
+	}
+	return drain(s.db.QueryContext(ctx, "SELECT content FROM files WHERE name IN ("+placeholders+") AND "+filter, append(queryArgs, args...)...))
+}
+
+// pageAssets returns the names of the assets of the page name.
+func (s SQLiteFS) pageAssets(ctx context.Context, name string) ([]string, error) {
+	var assets []string
+	if s.assets {
+		rows, err := s.db.QueryContext(ctx, "SELECT asset FROM assets WHERE name=? LIMIT ?", name, maxPrefetch)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var asset string
+			if err := rows.Scan(&asset); err != nil {
+				return nil, err
+			}
+			assets = append(assets, asset)
+		}
+		if err := rows.Err(); err != nil || len(assets) > 0 {
+			return assets, err
+		}
+	}
+
+	row, err := s.lookup(ctx, name, 0)
+	if err != nil {
+		return nil, err
+	}
+	content := row.content
+	if content == nil {
+		if content, err = s.loadContent(ctx, row.info.name, row.key); err != nil {
+			return nil, err
+		}
+	}
+	return htmlAssets(row.info.name, content), nil
+}
+
+// htmlAssets returns the names of the local files that the HTML page name
+// references with src and href attributes, resolved against its directory.
+func htmlAssets(name string, page []byte) []string {
+	var assets []string
+	seen := make(map[string]bool)
+	z := html.NewTokenizer(bytes.NewReader(page))
+	for len(assets) < maxPrefetch {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		tag, hasAttr := z.TagName()
+		attrs := make(map[string]string)
+		for hasAttr {
+			var key, val []byte
+			key, val, hasAttr = z.TagAttr()
+			attrs[string(key)] = string(val)
+		}
+		refs := []string{attrs["src"], attrs["poster"]}
+		switch string(tag) {
+		case "link":
+			// only what renders the page, not alternates and other pages
+			switch strings.ToLower(attrs["rel"]) {
+			case "stylesheet", "icon", "preload", "modulepreload", "manifest":
+				refs = append(refs, attrs["href"])
+			}
+		case "image", "use":
+			refs = append(refs, attrs["href"])
+		}
+		for _, ref := range refs {
+			if asset, ok := localAsset(name, ref); ok && !seen[asset] {
+				seen[asset] = true
+				assets = append(assets, asset)
+			}
+		}
+	}
+	return assets
+}
+
+// localAsset resolves the reference ref in the page name to a file name,
+// if it points into the same site.
+func localAsset(name, ref string) (string, bool) {
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		ref = ref[:i]
+	}
+	if ref == "" || strings.HasPrefix(ref, "//") || strings.Contains(ref, ":") {
+		return "", false
+	}
+	var asset string
+	if strings.HasPrefix(ref, "/") {
+		asset = path.Clean(strings.TrimPrefix(ref, "/"))
+	} else {
+		asset = path.Join(path.Dir(name), ref)
+	}
+	return asset, asset != "." && !strings.HasPrefix(asset, "../")
+}
@@ -0,0 +1,77 @@
+package sqlitefs
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// startPurge deletes the expired rows every PurgeExpired, so databases of
+// short-lived content don't keep growing with rows no one can see.
+func (s *SQLiteFS) startPurge() {
+	if s.PurgeExpired <= 0 || s.wdb == nil {
+		return
+	}
+	done := make(chan struct{})
+	s.stopPurge = func() { close(done) }
+	logger := s.logger.With(zap.String("db_path", s.DBPath))
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(s.PurgeExpired))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			n, err := s.purgeExpired()
+			if err != nil {
+				logger.Warn("purging expired files", zap.Error(err))
+				continue
+			}
+			if n > 0 {
+				logger.Info("purged expired files", zap.Int64("files", n))
+			}
+		}
+	}()
+}
+
+// purgeExpired deletes the rows that can't be served anymore, using the
+// files_expired_at index, and then the free pages of the database, which
+// incremental_vacuum only does with auto_vacuum=INCREMENTAL.
+func (s *SQLiteFS) purgeExpired() (int64, error) {
+	cutoff := time.Now().Unix()
+	if s.Expired == "stale" {
+		cutoff -= int64(time.Duration(s.StaleGrace).Seconds())
+	}
+	res, err := s.wdb.Exec("DELETE FROM files WHERE expired_at <= ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 && s.memCache != nil {
+		s.memCache.clear()
+	}
+
+	// pages freed by writes and removes as well
+	var free int64
+	if err := s.wdb.QueryRow("PRAGMA freelist_count").Scan(&free); err != nil {
+		return n, err
+	}
+	if free == 0 {
+		return n, nil
+	}
+	// each step frees a page, so it has to be read to the end
+	rows, err := s.wdb.Query("PRAGMA incremental_vacuum")
+	if err != nil {
+		return n, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return n, rows.Err()
+}
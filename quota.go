@@ -0,0 +1,198 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrQuotaExceeded is returned by writes that would take a tenant over
+// its quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits what may be stored. Zero fields are unlimited.
+type Quota struct {
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	MaxFiles int64 `json:"max_files,omitempty"`
+}
+
+// usage is the amount stored under one quota key.
+type usage struct {
+	bytes, files int64
+	computed     time.Time
+}
+
+// usageCache remembers usage computed from the database for a short while,
+// since summing content lengths scans every row of a tenant.
+type usageCache struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	usage map[string]usage
+}
+
+func newUsageCache(ttl time.Duration) *usageCache {
+	return &usageCache{ttl: ttl, usage: make(map[string]usage)}
+}
+
+func (c *usageCache) get(key string, compute func() (usage, error)) (usage, error) {
+	c.mu.Lock()
+	u, ok := c.usage[key]
+	c.mu.Unlock()
+	if ok && time.Since(u.computed) < c.ttl {
+		return u, nil
+	}
+	u, err := compute()
+	if err != nil {
+		return usage{}, err
+	}
+	u.computed = time.Now()
+	c.mu.Lock()
+	c.usage[key] = u
+	c.mu.Unlock()
+	return u, nil
+}
+
+// invalidate forgets the usage of key after a write changed it.
+func (c *usageCache) invalidate(key string) {
+	c.mu.Lock()
+	delete(c.usage, key)
+	c.mu.Unlock()
+}
+
+// checkTenantQuota returns ErrQuotaExceeded if tenant storing addBytes more
+// in addFiles more files would exceed TenantQuota. Write paths call it in
+// the transaction that changes the rows, and invalidate the tenant's usage
+// before it commits, so the next write, which waits for the write lock,
+// computes it anew.
+func (s SQLiteFS) checkTenantQuota(ctx context.Context, tx *sql.Tx, tenant string, addBytes, addFiles int64) error {
+	q := s.TenantQuota
+	if q == nil || s.tenantUsage == nil {
+		return nil
+	}
+	u, err := s.tenantUsage.get(tenant, func() (usage, error) {
+		var u usage
+		err := tx.QueryRowContext(ctx, "SELECT count(*), coalesce(sum("+s.sizeColumn()+"), 0) FROM files WHERE "+quoteIdent(s.TenantColumn)+"=? AND "+s.notDeleted(), tenant).Scan(&u.files, &u.bytes)
+		return u, err
+	})
+	if err != nil {
+		return fmt.Errorf("computing usage of tenant %q: %w", tenant, err)
+	}
+	if q.MaxBytes > 0 && u.bytes+addBytes > q.MaxBytes {
+		return fmt.Errorf("tenant %q would store %d bytes, over its limit of %d: %w", tenant, u.bytes+addBytes, q.MaxBytes, ErrQuotaExceeded)
+	}
+	if q.MaxFiles > 0 && u.files+addFiles > q.MaxFiles {
+		return fmt.Errorf("tenant %q would store %d files, over its limit of %d: %w", tenant, u.files+addFiles, q.MaxFiles, ErrQuotaExceeded)
+	}
+	return nil
+}
+
+// notDeleted returns the condition of the rows that aren't soft deleted,
+// which are all that count toward quotas.
+func (s SQLiteFS) notDeleted() string {
+	if s.columns["deleted_at"] {
+		return "deleted_at IS NULL"
+	}
+	return "1"
+}
+
+// checkStorageQuota makes sure storing addBytes more in addFiles more files
+// as name with key stays within StorageQuota and the PrefixQuotas name
+// falls under, evicting the oldest other files if QuotaExceeded is
+// "evict_oldest", or returns ErrQuotaExceeded. Only the rows of the
+// tenant and dataset of key count, and are evicted. Write paths call it in
+// the transaction that changes the rows.
+func (s SQLiteFS) checkStorageQuota(ctx context.Context, tx *sql.Tx, key writeKey, name string, addBytes, addFiles int64) error {
+	if s.StorageQuota != nil {
+		if err := s.fitQuota(ctx, tx, key, "", s.StorageQuota, name, addBytes, addFiles); err != nil {
+			return err
+		}
+	}
+	for prefix, q := range s.PrefixQuotas {
+		if strings.HasPrefix(name, prefix) {
+			if err := s.fitQuota(ctx, tx, key, prefix, q, name, addBytes, addFiles); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fitQuota enforces q on the files of key under prefix, or all of them if
+// it's empty.
+func (s SQLiteFS) fitQuota(ctx context.Context, tx *sql.Tx, key writeKey, prefix string, q *Quota, name string, addBytes, addFiles int64) error {
+	where, args := key.scope()
+	where += " AND " + s.notDeleted()
+	if prefix != "" {
+		where, args = where+" AND substr(name, 1, length(?))=?", append(args, prefix, prefix)
+	}
+	var files, bytes int64
+	err := tx.QueryRowContext(ctx, "SELECT count(DISTINCT name), coalesce(sum("+s.sizeColumn()+"), 0) FROM files WHERE "+where, args...).Scan(&files, &bytes)
+	if err != nil {
+		return fmt.Errorf("computing usage of %q: %w", prefix, err)
+	}
+	overBytes, overFiles := int64(0), int64(0)
+	if q.MaxBytes > 0 {
+		overBytes = bytes + addBytes - q.MaxBytes
+	}
+	if q.MaxFiles > 0 {
+		overFiles = files + addFiles - q.MaxFiles
+	}
+	if overBytes <= 0 && overFiles <= 0 {
+		return nil
+	}
+	scope := "the database"
+	if prefix != "" {
+		scope = strconv.Quote(prefix)
+	}
+	exceeded := fmt.Errorf("storing %s would take %s to %d bytes in %d files, over its limit of %d bytes in %d files: %w",
+		name, scope, bytes+addBytes, files+addFiles, q.MaxBytes, q.MaxFiles, ErrQuotaExceeded)
+	if s.QuotaExceeded != "evict_oldest" {
+		return exceeded
+	}
+
+	// pick the least recently modified files that free enough, all
+	// versions of a name together
+	rows, err := tx.QueryContext(ctx, "SELECT name, coalesce(sum("+s.sizeColumn()+"), 0) FROM files WHERE "+where+" AND name<>? GROUP BY name ORDER BY max(modified)", append(args, name)...)
+	if err != nil {
+		return err
+	}
+	var evict []any
+	for rows.Next() && (overBytes > 0 || overFiles > 0) {
+		var n string
+		var size int64
+		if err := rows.Scan(&n, &size); err != nil {
+			rows.Close()
+			return err
+		}
+		evict = append(evict, n)
+		overBytes -= size
+		overFiles--
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if overBytes > 0 || overFiles > 0 {
+		// even evicting everything else wouldn't be enough
+		return exceeded
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(evict)), ",")
+	query := "DELETE FROM files"
+	if s.columns["deleted_at"] {
+		// soft deleted, like removed files, so they can be restored
+		query = "UPDATE files SET deleted_at=strftime('%s','now')"
+	}
+	if _, err := tx.ExecContext(ctx, query+" WHERE name IN ("+placeholders+") AND "+where, append(evict, args...)...); err != nil {
+		return fmt.Errorf("evicting from %s: %w", scope, err)
+	}
+	s.logger.Info("evicted files over quota", zap.String("prefix", prefix), zap.Int("files", len(evict)), zap.String("for", name))
+	return nil
+}
@@ -0,0 +1,66 @@
+package sqlitefs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaEviction(t *testing.T) {
+	ten := []byte("0123456789")
+	for _, tc := range []struct {
+		name   string
+		fs     SQLiteFS
+		writes []string // by tenant a, a minute apart
+		err    error    // of the last write
+		left   string   // names of tenant a's rows that aren't deleted
+	}{
+		{"within the quota", SQLiteFS{StorageQuota: &Quota{MaxBytes: 30}}, []string{"1", "2", "3"}, nil, "1 2 3"},
+		{"rejected", SQLiteFS{StorageQuota: &Quota{MaxBytes: 25}}, []string{"1", "2", "3"}, ErrQuotaExceeded, "1 2"},
+		{"oldest evicted", SQLiteFS{StorageQuota: &Quota{MaxBytes: 25}, QuotaExceeded: "evict_oldest"}, []string{"1", "2", "3"}, nil, "2 3"},
+		{"evicted by files", SQLiteFS{StorageQuota: &Quota{MaxFiles: 2}, QuotaExceeded: "evict_oldest"}, []string{"1", "2", "3"}, nil, "2 3"},
+		{"replaced, not added", SQLiteFS{StorageQuota: &Quota{MaxFiles: 2}}, []string{"1", "2", "2"}, nil, "1 2"},
+		{"evicted under the prefix only", SQLiteFS{PrefixQuotas: map[string]*Quota{"up/": {MaxBytes: 15}}, QuotaExceeded: "evict_oldest"}, []string{"up/1", "2", "up/3"}, nil, "2 up/3"},
+		{"rewritten after its eviction", SQLiteFS{StorageQuota: &Quota{MaxFiles: 2}, QuotaExceeded: "evict_oldest"}, []string{"1", "2", "3", "1"}, nil, "1 3"},
+		{"too large even alone", SQLiteFS{StorageQuota: &Quota{MaxBytes: 5}, QuotaExceeded: "evict_oldest"}, []string{"1"}, ErrQuotaExceeded, ""},
+		{"chunks counted", SQLiteFS{ChunkSize: 4, TenantQuota: &Quota{MaxBytes: 25}}, []string{"1", "2", "3"}, ErrQuotaExceeded, "1 2"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fs.TenantColumn = "site"
+			s := newTestFS(t, tc.fs, "ALTER TABLE files ADD COLUMN site TEXT")
+			// of another tenant, which never counts nor is evicted
+			mustExec(t, s, "INSERT INTO files (name, content, modified, mode, site) VALUES ('0', '0123456789', 0, 420, 'b')")
+			ctx := WithTenant(context.Background(), "a")
+			var err error
+			for i, name := range tc.writes {
+				modified := time.Unix(int64(i+1)*60, 0)
+				if _, err = s.WriteFileContext(ctx, name, ten, WriteOptions{Modified: modified}); err != nil && i < len(tc.writes)-1 {
+					t.Fatalf("writing %s: %v", name, err)
+				}
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("last write: got %v, want %v", err, tc.err)
+			}
+			var left []string
+			rows, err := s.db.Query("SELECT name FROM files WHERE site='a' AND deleted_at IS NULL ORDER BY name")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var name string
+				rows.Scan(&name)
+				left = append(left, name)
+			}
+			rows.Close()
+			if got := strings.Join(left, " "); got != tc.left {
+				t.Errorf("rows left %q, want %q", got, tc.left)
+			}
+			var other int
+			if err := s.db.QueryRow("SELECT count(*) FROM files WHERE site='b' AND deleted_at IS NULL").Scan(&other); err != nil || other != 1 {
+				t.Errorf("rows of the other tenant: %d, %v", other, err)
+			}
+		})
+	}
+}
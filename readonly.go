@@ -0,0 +1,44 @@
+package sqlitefs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// detectReadOnly switches to opening the database immutable if it can't be
+// opened normally because it is on a read-only mount, where sqlite can't
+// create the -wal and -shm files WAL mode needs.
+func (s *SQLiteFS) detectReadOnly() error {
+	if s.db == nil || s.immutable || strings.HasPrefix(s.DBPath, "file:") {
+		return nil
+	}
+	err := s.db.Ping()
+	if err == nil || !dirReadOnly(filepath.Dir(s.DBPath)) {
+		return nil
+	}
+	s.logger.Warn("database is on a read-only file system, opening it immutable: changes to it are not seen until reload and uncheckpointed WAL content is missing",
+		zap.String("db_path", s.DBPath),
+		zap.NamedError("open_error", err))
+	if s.ExclusiveLocking {
+		closeExclusive(s.db)
+	} else {
+		s.db.Close()
+	}
+	s.db = nil
+	s.readOnly, s.immutable = true, true
+	return s.openDB()
+}
+
+// dirReadOnly reports whether files can't be created in dir.
+func dirReadOnly(dir string) bool {
+	f, err := os.CreateTemp(dir, ".sqlitefs-probe-*")
+	if err != nil {
+		return true
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return false
+}
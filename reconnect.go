@@ -0,0 +1,123 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The read handle of a file system is opened once, on Provision, and shared
+// by the copies the fs.FS methods work on; database/sql reconnects it one
+// connection at a time. After a query fails in the database, lookups fail
+// fast while the database is checked with exponential backoff, its idle
+// connections recycled before each check, until it answers again.
+
+const (
+	minRecheck = 100 * time.Millisecond
+	maxRecheck = 30 * time.Second
+)
+
+// dbHealth tracks whether the database of a file system answers.
+type dbHealth struct {
+	db     *sql.DB
+	idle   int // idle connections db keeps
+	logger *zap.Logger
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error // the failure being recovered from, nil while healthy
+}
+
+func newDBHealth(db *sql.DB, idle int, logger *zap.Logger) *dbHealth {
+	return &dbHealth{db: db, idle: idle, logger: logger, done: make(chan struct{})}
+}
+
+// recovering returns the failure the database is being checked after.
+func (h *dbHealth) recovering() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// failed starts checking the database after err, unless that is already
+// under way.
+func (h *dbHealth) failed(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err != nil {
+		return
+	}
+	h.err = err
+	go h.recheck()
+}
+
+func (h *dbHealth) recheck() {
+	wait := minRecheck
+	for {
+		select {
+		case <-time.After(wait):
+		case <-h.done:
+			return
+		}
+		err := h.check()
+		if err == nil {
+			h.mu.Lock()
+			h.err = nil
+			h.mu.Unlock()
+			h.logger.Info("database answers again")
+			return
+		}
+		wait = min(wait*2, maxRecheck)
+		h.logger.Warn("database still failing", zap.Error(err), zap.Duration("next_check", wait))
+	}
+}
+
+// check recycles the idle connections and reads the database header.
+func (h *dbHealth) check() error {
+	recycleIdle(h.db, h.idle)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var version int64
+	return h.db.QueryRowContext(ctx, "PRAGMA schema_version").Scan(&version)
+}
+
+func (h *dbHealth) close() {
+	close(h.done)
+}
+
+// usable returns an ErrDatabase while the database isn't open or is being
+// checked after a failure.
+func (s SQLiteFS) usable() error {
+	if s.db == nil {
+		return fmt.Errorf("%w: %w", ErrDatabase, errNotOpen)
+	}
+	if s.health == nil {
+		return nil
+	}
+	if err := s.health.recovering(); err != nil {
+		return fmt.Errorf("%w: unavailable after: %w", ErrDatabase, err)
+	}
+	return nil
+}
+
+// checkDatabase verifies that the database file exists and its files
+// table can be queried.
+func (s *SQLiteFS) checkDatabase() error {
+	if !strings.HasPrefix(s.DBPath, "file:") {
+		if _, err := os.Stat(s.DBPath); err != nil {
+			return fmt.Errorf("database: %w", err)
+		}
+	}
+	var n int
+	err := s.db.QueryRow("SELECT count(*) FROM (SELECT 1 FROM files LIMIT 1)").Scan(&n)
+	if err != nil {
+		return fmt.Errorf("%s: files table can't be queried, create_schema creates one: %w", s.DBPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package sqlitefs
+
+import (
+	"context"
+)
+
+// restricted reports whether name has a row hidden for one of the states
+// in PermissionDenied, so lookups fail with fs.ErrPermission instead of
+// fs.ErrNotExist.
+func (s SQLiteFS) restricted(ctx context.Context, name string) bool {
+	for _, state := range s.PermissionDenied {
+		var where string
+		var args []any
+		var ok bool
+		switch state {
+		case "private":
+			if s.previewing(ctx) || (!s.RequirePublished && !s.columns["publish_at"]) {
+				continue
+			}
+			var hidden string
+			if s.RequirePublished {
+				hidden = "NOT coalesce(published, 0)"
+			}
+			if s.columns["publish_at"] {
+				if hidden != "" {
+					hidden += " OR "
+				}
+				hidden += "publish_at > strftime('%s','now')"
+			}
+			where, args, ok = s.scopeFilterExcept(ctx, "published")
+			where = "(" + hidden + ") AND " + where
+		case "quota_exceeded":
+			if !s.columns["max_downloads"] {
+				continue
+			}
+			where, args, ok = s.scopeFilter(ctx)
+			where = "max_downloads <= 0 AND " + where
+		case "tenant_mismatch":
+			if s.TenantColumn == "" {
+				continue
+			}
+			where, args, ok = s.scopeFilterExcept(ctx, "tenant")
+			if tenant := s.tenant(ctx); tenant != "" {
+				where, args = quoteIdent(s.TenantColumn)+" IS NOT ? AND "+where, append([]any{tenant}, args...)
+			}
+		}
+		if !ok {
+			continue
+		}
+		var one int
+		err := s.db.QueryRowContext(ctx, "SELECT 1 FROM files WHERE name=? AND "+where+" LIMIT 1", append([]any{name}, args...)...).Scan(&one)
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
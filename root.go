@@ -0,0 +1,105 @@
+package sqlitefs
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// With Root, the file system serves the rows below a directory of the
+// files table as its own root, so one table can keep several sites.
+// Names stay those of the whole table in the database, in the headers
+// table and in the targets of aliases and symlinks. VirtualFiles and
+// mounts are named as served, and aren't below Root.
+
+// rootPrefix returns the root option without its slashes, "" for the
+// whole table.
+func rootPrefix(root string) (string, error) {
+	p := strings.Trim(root, "/")
+	if p == "" || p == "." {
+		return "", nil
+	}
+	if !fs.ValidPath(p) {
+		return "", fmt.Errorf("root %q must be a path below the root of the table", root)
+	}
+	return p, nil
+}
+
+// rootName returns the name the row of the served name has in the table.
+func (s SQLiteFS) rootName(name string) string {
+	if s.root == "" {
+		return name
+	}
+	if name == "." {
+		return s.root
+	}
+	return s.root + "/" + name
+}
+
+// servedName returns the name the row named stored is served by, the
+// reverse of rootName.
+func (s SQLiteFS) servedName(stored string) string {
+	if s.root == "" {
+		return stored
+	}
+	if stored == s.root {
+		return "."
+	}
+	return strings.TrimPrefix(stored, s.root+"/")
+}
+
+// withinRoot reports whether the row named stored is served with Root,
+// for the names links and aliases lead to.
+func (s SQLiteFS) withinRoot(stored string) bool {
+	return s.root == "" || stored == s.root || strings.HasPrefix(stored, s.root+"/")
+}
+
+// rootInfo returns fi with the names it is served by.
+func (s SQLiteFS) rootInfo(fi sqliteFileInfo) sqliteFileInfo {
+	if s.root == "" {
+		return fi
+	}
+	fi.name = s.servedName(fi.name)
+	if c := strings.TrimPrefix(fi.canonical, "/"); strings.HasPrefix(c, s.root+"/") {
+		fi.canonical = s.servedName(c)
+	}
+	return fi
+}
+
+// rootFile is f with the names of rootInfo. Directories keep their info
+// too, as their listing is found by it.
+func (s SQLiteFS) rootFile(f fs.File) fs.File {
+	switch f := f.(type) {
+	case *sqliteFile:
+		f.info = s.rootInfo(f.info)
+	case *sqliteDir:
+		f.info = s.rootInfo(f.info)
+	}
+	return f
+}
+
+// Sub implements fs.SubFS, serving the directory dir as the root like
+// Root does. File systems with mounts, a fallback or a per-request
+// db_path, whose names don't all come from one table, get the generic one
+// of fs.Sub.
+func (s SQLiteFS) Sub(dir string) (fs.FS, error) {
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+	if dir == "." {
+		return s, nil
+	}
+	if s.fallback != nil || len(s.mounts) > 0 || s.pool != nil {
+		// hidden from fs.Sub, which would call this again
+		return fs.Sub(struct{ fs.FS }{s}, dir)
+	}
+	sub := s
+	sub.root = s.rootName(s.normalizeName(dir))
+	sub.VirtualFiles = make(map[string]string)
+	for name, content := range s.VirtualFiles {
+		if rest, ok := strings.CutPrefix(name, dir+"/"); ok {
+			sub.VirtualFiles[rest] = content
+		}
+	}
+	return sub, nil
+}
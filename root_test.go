@@ -0,0 +1,68 @@
+package sqlitefs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+func TestRootTargets(t *testing.T) {
+	s := newTestFS(t, SQLiteFS{Root: "sites/blog"},
+		`INSERT INTO files (name, content, modified, mode) VALUES
+			('sites/blog/index.html', 'blog', 1, 420),
+			('sites/blog/inside', 'index.html', 1, 134218148),
+			('sites/blog/outside', '../shop/secret.txt', 1, 134218148),
+			('sites/blog/absolute', '/sites/shop/secret.txt', 1, 134218148),
+			('sites/shop/secret.txt', 'secret', 1, 420)`,
+		`INSERT INTO aliases (alias, target) VALUES
+			('sites/blog/old.html', 'sites/blog/index.html'),
+			('sites/blog/leak.html', 'sites/shop/secret.txt')`)
+	for _, tc := range []struct {
+		name    string
+		content string // "" for not found
+	}{
+		{"index.html", "blog"},
+		{"inside", "blog"},
+		{"old.html", "blog"},
+		{"outside", ""},
+		{"absolute", ""},
+		{"leak.html", ""},
+	} {
+		f, err := s.Open(tc.name)
+		if tc.content == "" {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: got %v, want fs.ErrNotExist", tc.name, err)
+			}
+			if err == nil {
+				f.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		b, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(b) != tc.content {
+			t.Errorf("%s: read %q, %v, want %q", tc.name, b, err, tc.content)
+		}
+	}
+}
+
+func TestRootUploadPolicy(t *testing.T) {
+	s := newTestFS(t, SQLiteFS{Root: "sites/blog", UploadPolicy: &UploadPolicy{NamePatterns: []string{`^posts/`}}})
+	ctx := context.Background()
+	if _, err := s.WriteFileContext(ctx, "posts/a.txt", []byte("a"), WriteOptions{}); err != nil {
+		t.Fatalf("writing a name the policy allows: %v", err)
+	}
+	if _, err := s.WriteFileContext(ctx, "drafts/a.txt", []byte("a"), WriteOptions{}); !errors.Is(err, ErrRejected) {
+		t.Fatalf("writing a name the policy rejects: got %v, want ErrRejected", err)
+	}
+	var n int
+	if err := s.db.QueryRow("SELECT count(*) FROM files WHERE name='sites/blog/posts/a.txt'").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("rows stored below the root: %d, %v", n, err)
+	}
+}
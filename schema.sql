@@ -3,5 +3,80 @@ CREATE TABLE IF NOT EXISTS "files" (
 	"content" BLOB,          -- file bytes
 	"modified" INTEGER,      -- unix timestamp of last modification
 	"mode" INTEGER,          -- file mode
-	"expired_at" INTEGER     -- unix timestamp when file expires (NULL means never)
+	"expired_at" INTEGER,    -- unix timestamp when file expires (NULL means never)
+	"publish_at" INTEGER,    -- unix timestamp before which the file is hidden (NULL means immediately)
+	"max_downloads" INTEGER, -- downloads left before the file behaves as expired (NULL means unlimited)
+	"deleted_at" INTEGER,    -- unix timestamp of a soft delete (NULL means not deleted)
+	"canonical" TEXT,        -- name to redirect to when served under this one (NULL means this one)
+	"external" TEXT,         -- path or URL of content kept outside the database (NULL means content)
+	"encoding" TEXT,         -- how content is stored, 'raw' or 'base64' (NULL means content_encoding)
+	"last_accessed" INTEGER, -- unix timestamp of the last open, maintained with track_access
+	"integrity" TEXT,        -- Subresource Integrity hash of content (NULL until first needed)
+	"published" INTEGER,     -- 0 or NULL for drafts, hidden by require_published
+	"chunks" TEXT,           -- id of the file_chunks pieces holding the content (NULL means content)
+	"compression" TEXT,      -- how content is compressed, 'gzip' or 'zstd' (NULL means not compressed)
+	"content_type" TEXT      -- media type to serve content as (NULL means guessed from the name)
 ) WITHOUT ROWID;
+
+-- for finding expired rows without a scan
+CREATE INDEX IF NOT EXISTS "files_expired_at" ON "files" ("expired_at");
+
+-- clears the integrity hash when content changes, so it is computed again
+CREATE TRIGGER IF NOT EXISTS "files_integrity" AFTER UPDATE OF "content" ON "files"
+WHEN NEW."integrity" IS OLD."integrity"
+BEGIN
+	UPDATE "files" SET "integrity" = NULL WHERE "name" = NEW."name";
+END;
+
+-- optional: old names that keep resolving to files after a rename
+CREATE TABLE IF NOT EXISTS "aliases" (
+	"alias" TEXT PRIMARY KEY, -- name that is looked up
+	"target" TEXT             -- name of the file (or another alias) it resolves to
+) WITHOUT ROWID;
+
+-- optional: response headers of single files, served by sqlite_file_server
+CREATE TABLE IF NOT EXISTS "headers" (
+	"name" TEXT,   -- name of the file
+	"header" TEXT, -- header field, such as Cache-Control
+	"value" TEXT,
+	PRIMARY KEY ("name", "header")
+) WITHOUT ROWID;
+
+-- optional: local assets that pages reference, prefetched when they are served
+CREATE TABLE IF NOT EXISTS "assets" (
+	"name" TEXT,  -- name of the page
+	"asset" TEXT, -- name of a file it references
+	PRIMARY KEY ("name", "asset")
+) WITHOUT ROWID;
+
+-- optional: HTML rendered from Markdown files by sqlite_file_server's markdown
+CREATE TABLE IF NOT EXISTS "rendered" (
+	"hash" TEXT PRIMARY KEY,  -- SHA-256 of the Markdown source, hex
+	"html" BLOB,              -- the rendered page
+	"rendered_at" INTEGER     -- unix timestamp of rendering
+) WITHOUT ROWID;
+
+-- optional: content of large files in ordered pieces, served one at a time
+CREATE TABLE IF NOT EXISTS "file_chunks" (
+	"id" TEXT,     -- the chunks of the rows whose content this is
+	"seq" INTEGER, -- position of the piece, from 0
+	"data" BLOB,
+	PRIMARY KEY ("id", "seq")
+) WITHOUT ROWID;
+
+-- for finding whether another row still holds the pieces
+CREATE INDEX IF NOT EXISTS "files_chunks" ON "files" ("chunks") WHERE "chunks" IS NOT NULL;
+
+-- delete the pieces that no row holds anymore
+CREATE TRIGGER IF NOT EXISTS "files_chunks_delete" AFTER DELETE ON "files"
+WHEN OLD."chunks" IS NOT NULL
+BEGIN
+	DELETE FROM "file_chunks" WHERE "id" = OLD."chunks"
+		AND NOT EXISTS (SELECT 1 FROM "files" WHERE "chunks" = OLD."chunks");
+END;
+CREATE TRIGGER IF NOT EXISTS "files_chunks_update" AFTER UPDATE OF "chunks" ON "files"
+WHEN OLD."chunks" IS NOT NULL AND OLD."chunks" IS NOT NEW."chunks"
+BEGIN
+	DELETE FROM "file_chunks" WHERE "id" = OLD."chunks"
+		AND NOT EXISTS (SELECT 1 FROM "files" WHERE "chunks" = OLD."chunks");
+END;
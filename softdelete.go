@@ -0,0 +1,44 @@
+package sqlitefs
+
+import (
+	"context"
+	"io/fs"
+	"time"
+)
+
+// deletedFile is a soft deleted row.
+type deletedFile struct {
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+func (s SQLiteFS) listDeleted(ctx context.Context) ([]deletedFile, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT name, deleted_at FROM files WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deleted := []deletedFile{}
+	for rows.Next() {
+		var name string
+		var ts int64
+		if err := rows.Scan(&name, &ts); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, deletedFile{Name: name, DeletedAt: time.Unix(ts, 0)})
+	}
+	return deleted, rows.Err()
+}
+
+// restore undoes the soft delete of name.
+func (s SQLiteFS) restore(ctx context.Context, name string) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE files SET deleted_at=NULL WHERE name=? AND deleted_at IS NOT NULL", name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fs.ErrNotExist
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package sqlitefs
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+)
+
+func init() {
+	caddy.RegisterModule(SQLiteStorage{})
+}
+
+const storageSchema = `
+CREATE TABLE IF NOT EXISTS "certmagic_data" (
+	"key" TEXT PRIMARY KEY,
+	"value" BLOB,
+	"modified" INTEGER
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS "certmagic_locks" (
+	"name" TEXT PRIMARY KEY,
+	"expires" INTEGER,
+	"owner" TEXT -- random id of the holder, so only it unlocks
+) WITHOUT ROWID;
+`
+
+// SQLiteStorage implements certmagic.Storage in a sqlite database, so
+// certificates can live alongside the files served by SQLiteFS.
+type SQLiteStorage struct {
+	DBPath string `json:"db_path,omitempty"`
+
+	// How long a lock is held without being refreshed before other
+	// instances consider it stale. Default: 2m.
+	LockTimeout caddy.Duration `json:"lock_timeout,omitempty"`
+
+	db    *sql.DB
+	locks *heldLocks
+}
+
+// heldLocks tracks the locks held by this instance.
+type heldLocks struct {
+	mu   sync.Mutex
+	held map[string]heldLock
+}
+
+// heldLock is a lock held by this instance, with the owner id of its row
+// and the cancel func of its refresher.
+type heldLock struct {
+	owner  string
+	cancel context.CancelFunc
+}
+
+// CaddyModule returns the Caddy module information.
+func (SQLiteStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.sqlite",
+		New: func() caddy.Module { return new(SQLiteStorage) },
+	}
+}
+
+func (s *SQLiteStorage) Provision(ctx caddy.Context) error {
+	if s.LockTimeout <= 0 {
+		s.LockTimeout = caddy.Duration(2 * time.Minute)
+	}
+	db, err := openSQLite(s.DBPath)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(storageSchema); err != nil {
+		db.Close()
+		return fmt.Errorf("creating storage tables: %w", err)
+	}
+	// missing from tables created before it
+	if err := addColumn(db, "certmagic_locks", "owner", "TEXT"); err != nil {
+		db.Close()
+		return err
+	}
+	s.db = db
+	s.locks = &heldLocks{held: make(map[string]heldLock)}
+	return nil
+}
+
+func (s *SQLiteStorage) Cleanup() error {
+	if s.locks != nil {
+		s.locks.mu.Lock()
+		for _, l := range s.locks.held {
+			l.cancel()
+		}
+		s.locks.held = nil
+		s.locks.mu.Unlock()
+	}
+	if s.db != nil {
+		return s.db.Close()
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) Validate() error {
+	if s.DBPath == "" {
+		return errors.New("db_path is required")
+	}
+	if s.LockTimeout > 0 && time.Duration(s.LockTimeout) < time.Second {
+		// expiries are kept in seconds
+		return errors.New("lock_timeout must be at least 1s")
+	}
+	return nil
+}
+
+// CertMagicStorage converts s to a certmagic.Storage instance.
+func (s *SQLiteStorage) CertMagicStorage() (certmagic.Storage, error) {
+	return s, nil
+}
+
+// Store implements certmagic.Storage.
+func (s *SQLiteStorage) Store(ctx context.Context, key string, value []byte) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO certmagic_data (key, value, modified) VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET value=excluded.value, modified=excluded.modified`,
+		key, value, time.Now().Unix())
+	return err
+}
+
+// Load implements certmagic.Storage.
+func (s *SQLiteStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM certmagic_data WHERE key=?", key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fs.ErrNotExist
+	}
+	return value, err
+}
+
+// Delete implements certmagic.Storage, removing key and every key under it.
+func (s *SQLiteStorage) Delete(ctx context.Context, key string) error {
+	lo, hi := prefixRange(key)
+	_, err := s.db.ExecContext(ctx, "DELETE FROM certmagic_data WHERE key=? OR (key > ? AND key < ?)", key, lo, hi)
+	return err
+}
+
+// Exists implements certmagic.Storage.
+func (s *SQLiteStorage) Exists(ctx context.Context, key string) bool {
+	lo, hi := prefixRange(key)
+	var n int
+	err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM certmagic_data WHERE key=? OR (key > ? AND key < ?) LIMIT 1", key, lo, hi).Scan(&n)
+	return err == nil && n > 0
+}
+
+// List implements certmagic.Storage.
+func (s *SQLiteStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	lo, hi := prefixRange(prefix)
+	rows, err := s.db.QueryContext(ctx, "SELECT key FROM certmagic_data WHERE key > ? AND key < ? ORDER BY key", lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if !recursive {
+			// collapse deeper keys into their first-level "directory"
+			rest := strings.TrimPrefix(key, lo)
+			if i := strings.IndexByte(rest, '/'); i >= 0 {
+				key = path.Join(prefix, rest[:i])
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return keys, nil
+}
+
+// Stat implements certmagic.Storage.
+func (s *SQLiteStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	var size, modified int64
+	err := s.db.QueryRowContext(ctx, "SELECT length(value), modified FROM certmagic_data WHERE key=?", key).Scan(&size, &modified)
+	if err == nil {
+		return certmagic.KeyInfo{Key: key, Modified: time.Unix(modified, 0), Size: size, IsTerminal: true}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return certmagic.KeyInfo{}, err
+	}
+	if s.Exists(ctx, key) {
+		return certmagic.KeyInfo{Key: key, IsTerminal: false}, nil
+	}
+	return certmagic.KeyInfo{}, fs.ErrNotExist
+}
+
+// Lock implements certmagic.Locker. Locks are rows with an expiry that the
+// holder keeps pushing forward; an expired row is taken over.
+func (s *SQLiteStorage) Lock(ctx context.Context, name string) error {
+	timeout := time.Duration(s.LockTimeout)
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	owner := hex.EncodeToString(b)
+	for {
+		now := time.Now()
+		res, err := s.db.ExecContext(ctx, `INSERT INTO certmagic_locks (name, expires, owner) VALUES (?, ?, ?)
+			ON CONFLICT(name) DO UPDATE SET expires=excluded.expires, owner=excluded.owner WHERE expires < ?`,
+			name, now.Add(timeout).Unix(), owner, now.Unix())
+		if err != nil {
+			return fmt.Errorf("acquiring lock %s: %w", name, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			s.keepLock(name, owner)
+			return nil
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// keepLock refreshes the expiry of the lock held as owner until it is
+// unlocked.
+func (s *SQLiteStorage) keepLock(name, owner string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.locks.mu.Lock()
+	if prev, ok := s.locks.held[name]; ok {
+		prev.cancel()
+	}
+	if s.locks.held == nil {
+		// cleaned up; don't start a refresher that nothing will stop
+		s.locks.mu.Unlock()
+		cancel()
+		return
+	}
+	s.locks.held[name] = heldLock{owner: owner, cancel: cancel}
+	s.locks.mu.Unlock()
+
+	timeout := time.Duration(s.LockTimeout)
+	go func() {
+		ticker := time.NewTicker(timeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, _ = s.db.ExecContext(ctx, "UPDATE certmagic_locks SET expires=? WHERE name=? AND owner=?", time.Now().Add(timeout).Unix(), name, owner)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Unlock implements certmagic.Locker. A lock that expired and was taken
+// over by another instance is left to that one.
+func (s *SQLiteStorage) Unlock(ctx context.Context, name string) error {
+	s.locks.mu.Lock()
+	l, ok := s.locks.held[name]
+	if ok {
+		l.cancel()
+		delete(s.locks.held, name)
+	}
+	s.locks.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("lock %s is not held", name)
+	}
+	_, err := s.db.ExecContext(ctx, "DELETE FROM certmagic_locks WHERE name=? AND owner=?", name, l.owner)
+	return err
+}
+
+func (s *SQLiteStorage) String() string { return "sqlite:" + s.DBPath }
+
+// prefixRange returns bounds selecting every key below dir, using '0' as
+// the byte immediately after '/' so the primary key index is used.
+func prefixRange(dir string) (string, string) {
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		return "", "\xff"
+	}
+	return dir + "/", dir + "0"
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	sqlite <db_path> {
+//		lock_timeout <duration>
+//	}
+func (s *SQLiteStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			s.DBPath = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "db_path":
+				if !d.AllArgs(&s.DBPath) {
+					return d.ArgErr()
+				}
+			case "lock_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing lock_timeout: %v", err)
+				}
+				s.LockTimeout = caddy.Duration(dur)
+			default:
+				return d.Errf("unrecognized parameter '%s'", d.Val())
+			}
+		}
+	}
+	if s.DBPath == "" {
+		return d.Err("missing db_path")
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.StorageConverter = (*SQLiteStorage)(nil)
+	_ caddy.Provisioner      = (*SQLiteStorage)(nil)
+	_ caddy.CleanerUpper     = (*SQLiteStorage)(nil)
+	_ caddy.Validator        = (*SQLiteStorage)(nil)
+	_ certmagic.Storage      = (*SQLiteStorage)(nil)
+	_ caddyfile.Unmarshaler  = (*SQLiteStorage)(nil)
+)
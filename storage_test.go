@@ -0,0 +1,66 @@
+package sqlitefs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestStorageLockTakenOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certs.db")
+	ctx := context.Background()
+	var a, b SQLiteStorage
+	for _, s := range []*SQLiteStorage{&a, &b} {
+		s.DBPath = path
+		if err := s.Provision(caddy.Context{}); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Cleanup()
+	}
+	if err := a.Lock(ctx, "issue"); err != nil {
+		t.Fatal(err)
+	}
+	// as if a stopped refreshing it
+	if _, err := a.db.Exec("UPDATE certmagic_locks SET expires=?", time.Now().Add(-time.Minute).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	lockCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := b.Lock(lockCtx, "issue"); err != nil {
+		t.Fatalf("taking over the expired lock: %v", err)
+	}
+	if err := a.Unlock(ctx, "issue"); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := b.db.QueryRow("SELECT count(*) FROM certmagic_locks WHERE name='issue'").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("lock rows after the old holder unlocked: %d, %v", n, err)
+	}
+	if err := b.Unlock(ctx, "issue"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.db.QueryRow("SELECT count(*) FROM certmagic_locks").Scan(&n); err != nil || n != 0 {
+		t.Fatalf("lock rows after unlocking: %d, %v", n, err)
+	}
+}
+
+func TestStorageValidateLockTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		timeout time.Duration
+		ok      bool
+	}{
+		{0, true},
+		{time.Nanosecond, false},
+		{500 * time.Millisecond, false},
+		{time.Second, true},
+		{2 * time.Minute, true},
+	} {
+		s := SQLiteStorage{DBPath: "certs.db", LockTimeout: caddy.Duration(tc.timeout)}
+		if err := s.Validate(); (err == nil) != tc.ok {
+			t.Errorf("lock_timeout %s: got %v", tc.timeout, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+)
+
+const (
+	// Content above StreamThreshold is read in pieces with substr instead
+	// of whole, so a seek into a large video only reads what is served.
+	defaultStreamThreshold = 1 << 20
+	defaultStreamChunkSize = 256 << 10
+
+	// Sequential pieces double in size up to this many times the first,
+	// since sqlite reads the whole blob for every piece: fewer, larger
+	// queries for downloads, small ones after a seek.
+	maxChunkGrowth = 16
+)
+
+// substrReader reads the content of a row a piece at a time.
+type substrReader struct {
+	ctx     context.Context
+	timeout time.Duration // of each piece
+	db      *sql.DB
+	metrics *instanceMetrics
+	query   string
+	args    []any
+	size    int64
+	off     int64
+
+	minChunk, chunk int64
+
+	buf    []byte
+	bufOff int64 // offset of buf in the content
+}
+
+// openSubstr returns a reader of the size bytes of content of the row of
+// name with key, as long as it is still in scope for ctx.
+func (s SQLiteFS) openSubstr(ctx context.Context, name string, key rowKey, size int64) (*substrReader, error) {
+	scope, args, ok := s.scopeFilter(ctx)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	where, keyArgs := key.where(name)
+	chunk := s.StreamChunkSize
+	if chunk <= 0 {
+		chunk = defaultStreamChunkSize
+	}
+	return &substrReader{
+		ctx:      ctx,
+		timeout:  time.Duration(s.Timeout),
+		db:       s.db,
+		metrics:  s.metrics,
+		query:    "SELECT substr(content, ?, ?) FROM files WHERE " + where + " AND " + scope + " LIMIT 1",
+		args:     append(keyArgs, args...),
+		size:     size,
+		minChunk: chunk,
+		chunk:    chunk,
+	}, nil
+}
+
+func (r *substrReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.off < r.bufOff || r.off >= r.bufOff+int64(len(r.buf)) {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[r.off-r.bufOff:])
+	r.off += int64(n)
+	return n, nil
+}
+
+// fill reads the piece starting at the current offset.
+func (r *substrReader) fill() error {
+	if r.buf != nil && r.off == r.bufOff+int64(len(r.buf)) {
+		r.chunk = min(r.chunk*2, r.minChunk*maxChunkGrowth)
+	} else {
+		r.chunk = r.minChunk
+	}
+	ctx := r.ctx
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	var chunk []byte
+	start := time.Now()
+	// substr counts from 1
+	err := r.db.QueryRowContext(ctx, r.query, append([]any{r.off + 1, r.chunk}, r.args...)...).Scan(&chunk)
+	r.metrics.queried("chunk", start)
+	if errors.Is(err, sql.ErrNoRows) {
+		// removed since it was opened
+		return fs.ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+	if len(chunk) == 0 {
+		// shrunk since it was opened
+		return io.ErrUnexpectedEOF
+	}
+	r.metrics.read(len(chunk))
+	r.buf, r.bufOff = chunk, r.off
+	return nil
+}
+
+func (r *substrReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("substrReader.Seek: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
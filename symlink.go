@@ -0,0 +1,99 @@
+package sqlitefs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Rows with fs.ModeSymlink in their mode are symlinks whose content is the
+// target, relative to the link's directory or, with a leading slash, to the
+// root. Open and Stat follow them; ReadLink and Lstat implement
+// fs.ReadLinkFS for consumers that represent links themselves.
+
+// ReadLink returns the target of the symlink name.
+func (s SQLiteFS) ReadLink(name string) (string, error) {
+	if m, rest := s.mounted(name); m != nil {
+		return m.fsys.ReadLink(rest)
+	}
+	if s.pool != nil {
+		// without a request, there is no database to read
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	}
+	row, err := s.lstat(context.Background(), "readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if row.info.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return string(row.content), nil
+}
+
+// Lstat returns the FileInfo of name without following a symlink.
+func (s SQLiteFS) Lstat(name string) (fs.FileInfo, error) {
+	if m, rest := s.mounted(name); m != nil && rest != "." {
+		info, err := m.fsys.Lstat(rest)
+		if fi, ok := info.(sqliteFileInfo); ok {
+			return m.info(fi), nil
+		}
+		return info, err
+	}
+	if s.pool != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+	}
+	row, err := s.lstat(context.Background(), "lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return s.rootInfo(row.info), nil
+}
+
+func (s SQLiteFS) lstat(ctx context.Context, op, name string) (*fileRow, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if err := s.usable(); err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	stored := s.normalizeName(name)
+	if f, ok := s.openVirtual(stored); ok {
+		return &fileRow{info: f.(*sqliteFile).info}, nil
+	}
+	stored = s.rootName(stored)
+	if !s.nameAllowed(stored) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	row, err := s.lookup(ctx, stored, 0)
+	if errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrGone) {
+		if info, ok := s.impliedDirInfo(ctx, stored); ok {
+			return &fileRow{info: info}, nil
+		}
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return row, nil
+}
+
+// followLink is linkTarget, also refusing targets outside Root.
+func (s SQLiteFS) followLink(name, target string) (string, bool) {
+	target, ok := linkTarget(name, target)
+	return target, ok && s.withinRoot(target)
+}
+
+// linkTarget resolves the target of the symlink name to a file name,
+// refusing targets outside the root.
+func linkTarget(name, target string) (string, bool) {
+	if strings.HasPrefix(target, "/") {
+		target = path.Clean(strings.TrimPrefix(target, "/"))
+	} else {
+		target = path.Join(path.Dir(name), target)
+	}
+	if target == ".." || strings.HasPrefix(target, "../") || !fs.ValidPath(target) {
+		return "", false
+	}
+	return target, true
+}
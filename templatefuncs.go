@@ -0,0 +1,72 @@
+package sqlitefs
+
+import (
+	"context"
+	"text/template"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/templates"
+)
+
+func init() {
+	caddy.RegisterModule(TemplateFunctions{})
+}
+
+// TemplateFunctions adds functions for the files of a sqlite file system to
+// the templates handler:
+//
+//	{{sqlitefsIntegrity "js/app.js"}}
+//
+// returns the Subresource Integrity hash of a file. The file system is the
+// one provisioned with DBPath, which may be left out if there is only one.
+// Names are looked up without a request, so tenant and other request
+// placeholders resolve empty; sqlite_file_server's
+// {http.sqlitefs.integrity.*} placeholder has the request.
+type TemplateFunctions struct {
+	DBPath string `json:"db_path,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (TemplateFunctions) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.templates.functions.sqlitefs",
+		New: func() caddy.Module { return new(TemplateFunctions) },
+	}
+}
+
+// CustomTemplateFunctions implements templates.CustomFunctions.
+func (tf TemplateFunctions) CustomTemplateFunctions() template.FuncMap {
+	return template.FuncMap{
+		"sqlitefsIntegrity": func(name string) (string, error) {
+			// looked up on use, the file system may be provisioned later
+			s, err := lookupInstance(tf.DBPath)
+			if err != nil {
+				return "", err
+			}
+			return s.Integrity(context.Background(), name)
+		},
+	}
+}
+
+// UnmarshalCaddyfile sets up the functions from Caddyfile tokens, in the
+// extensions block of templates. Syntax:
+//
+//	sqlitefs [<db_path>]
+func (tf *TemplateFunctions) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			tf.DBPath = adaptDBPath(d, d.Val())
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ templates.CustomFunctions = (*TemplateFunctions)(nil)
+	_ caddyfile.Unmarshaler     = (*TemplateFunctions)(nil)
+)
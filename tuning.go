@@ -0,0 +1,76 @@
+package sqlitefs
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Pragmas run on each new connection of the read handle, after the ones of
+// the connection string, so they can override busy_timeout as well.
+
+// defaultMaxIdleConns is the idle connections database/sql keeps by
+// default.
+const defaultMaxIdleConns = 2
+
+var (
+	pragmaName  = regexp.MustCompile(`^[a-z_]+$`)
+	pragmaValue = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+)
+
+// maxIdleConns returns the idle connections the read handle keeps.
+func (s SQLiteFS) maxIdleConns() int {
+	if s.MaxIdleConns > 0 {
+		return s.MaxIdleConns
+	}
+	return defaultMaxIdleConns
+}
+
+// setPoolSize sizes the connection pool of db as configured.
+func (s SQLiteFS) setPoolSize(db *sql.DB) {
+	if s.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(s.MaxOpenConns)
+	}
+	db.SetMaxIdleConns(s.maxIdleConns())
+}
+
+// recycleIdle closes the idle connections of db, keeping up to idle of
+// them again afterwards.
+func recycleIdle(db *sql.DB, idle int) {
+	db.SetMaxIdleConns(0)
+	db.SetMaxIdleConns(idle)
+}
+
+// pragmaHook returns the setup key and the connect hook of Pragmas, in
+// name order.
+func (s SQLiteFS) pragmaHook() (string, func(sqliteConn) error, error) {
+	names := make([]string, 0, len(s.Pragmas))
+	for name, value := range s.Pragmas {
+		if !pragmaName.MatchString(name) {
+			return "", nil, fmt.Errorf("invalid pragma name %q", name)
+		}
+		if !pragmaValue.MatchString(value) {
+			return "", nil, fmt.Errorf("invalid value %q of pragma %s", value, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stmts := make([]string, len(names))
+	for i, name := range names {
+		stmts[i] = "PRAGMA " + name + " = " + s.Pragmas[name]
+	}
+	sum := sha256.Sum256([]byte(strings.Join(stmts, ";")))
+	return "pragma_" + hex.EncodeToString(sum[:8]), func(conn sqliteConn) error {
+		for _, stmt := range stmts {
+			if _, err := conn.ExecContext(context.Background(), stmt, nil); err != nil {
+				return fmt.Errorf("%s: %w", stmt, err)
+			}
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,158 @@
+package sqlitefs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ErrRejected is returned by writes of files that the upload policy
+// doesn't allow.
+var ErrRejected = errors.New("rejected by upload policy")
+
+// UploadPolicy restricts what the write paths accept. Zero fields don't
+// restrict anything.
+type UploadPolicy struct {
+	// The largest file accepted, in bytes.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Content types accepted, as patterns such as image/*. The type comes
+	// from the extension of the name or, without a known one, from the
+	// content.
+	AllowedTypes []string `json:"allowed_types,omitempty"`
+
+	// Extensions accepted, such as .jpg, compared without case.
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
+
+	// Regular expressions that names must all match, such as
+	// ^uploads/[a-z0-9-]+\.[a-z]+$.
+	NamePatterns []string `json:"name_patterns,omitempty"`
+
+	// A URL the content of each file is POSTed to before it is stored, such
+	// as a malware scanner. Any 2xx response accepts the file and a 4xx
+	// rejects it with the response body as the reason; anything else fails
+	// the write, so an unreachable scanner lets nothing through.
+	ScanURL string `json:"scan_url,omitempty"`
+
+	// How long to wait for ScanURL. Default: 30s.
+	ScanTimeout caddy.Duration `json:"scan_timeout,omitempty"`
+
+	names []*regexp.Regexp
+}
+
+// provision compiles the name patterns.
+func (p *UploadPolicy) provision() error {
+	p.names = p.names[:0]
+	for _, pattern := range p.NamePatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("upload policy name pattern %q: %v", pattern, err)
+		}
+		p.names = append(p.names, re)
+	}
+	if p.ScanTimeout <= 0 {
+		p.ScanTimeout = caddy.Duration(30 * time.Second)
+	}
+	return nil
+}
+
+// checkUpload returns ErrRejected, wrapped with the reason, if UploadPolicy
+// doesn't allow storing content as name, to be served as contentType if
+// not "". Write paths call it before they begin their transaction, since a
+// scan can take a while.
+func (s SQLiteFS) checkUpload(ctx context.Context, name, contentType string, content []byte) error {
+	p := s.UploadPolicy
+	if p == nil {
+		return nil
+	}
+	if p.MaxSize > 0 && int64(len(content)) > p.MaxSize {
+		return fmt.Errorf("%s is %d bytes, over the limit of %d: %w", name, len(content), p.MaxSize, ErrRejected)
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if len(p.AllowedExtensions) > 0 && !containsFold(p.AllowedExtensions, ext) {
+		return fmt.Errorf("%s: extension %q is not allowed: %w", name, ext, ErrRejected)
+	}
+	if contentType == "" {
+		contentType = uploadType(name, content)
+	}
+	if len(p.AllowedTypes) > 0 && !typeAllowed(p.AllowedTypes, contentType) {
+		return fmt.Errorf("%s: content type %s is not allowed: %w", name, contentType, ErrRejected)
+	}
+	for _, re := range p.names {
+		if !re.MatchString(name) {
+			return fmt.Errorf("%s doesn't match %s: %w", name, re, ErrRejected)
+		}
+	}
+	if p.ScanURL != "" {
+		return p.scan(ctx, name, contentType, content)
+	}
+	return nil
+}
+
+// scan submits content to ScanURL.
+func (p *UploadPolicy) scan(ctx context.Context, name, contentType string, content []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.ScanTimeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.ScanURL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Sqlitefs-Name", name)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("scanning %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	reason, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return fmt.Errorf("%s: scan: %s: %w", name, strings.TrimSpace(string(reason)), ErrRejected)
+	default:
+		return fmt.Errorf("scanning %s: %s", name, resp.Status)
+	}
+}
+
+// uploadType returns the content type of a file to be stored.
+func uploadType(name string, content []byte) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return http.DetectContentType(content)
+}
+
+// typeAllowed reports whether contentType, without parameters, matches
+// one of the patterns.
+func typeAllowed(patterns []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package sqlitefs
+
+import (
+	"io/fs"
+	"strings"
+)
+
+// openVirtual opens name from VirtualFiles. They are read-only and dated
+// to when the config was loaded.
+func (s SQLiteFS) openVirtual(name string) (fs.File, bool) {
+	content, ok := s.VirtualFiles[name]
+	if !ok {
+		return nil, false
+	}
+	return &sqliteFile{
+		reader: strings.NewReader(content),
+		info: sqliteFileInfo{
+			name:    name,
+			size:    int64(len(content)),
+			modTime: s.provisioned,
+			mode:    0o444,
+		},
+	}, true
+}
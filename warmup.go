@@ -0,0 +1,89 @@
+package sqlitefs
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Warmup is work done on Provision so the first requests after a start
+// or reload don't pay for a cold cache.
+type Warmup struct {
+	// A representative query to run, such as a lookup of the home page.
+	// Default: SELECT count(*) FROM files.
+	Query string `json:"query,omitempty"`
+
+	// Read this many bytes from the start of the database file into the
+	// operating system's page cache.
+	Bytes int64 `json:"bytes,omitempty"`
+
+	// Load the content of the files opened most over the last week, from
+	// the hits table kept by TrackHits.
+	HotFiles int `json:"hot_files,omitempty"`
+}
+
+// warmup runs the configured warm-up, only logging failures since a cold
+// cache is no reason not to start.
+func (s *SQLiteFS) warmup() {
+	w := s.Warmup
+	if w == nil || s.db == nil {
+		return
+	}
+	start := time.Now()
+	logger := s.logger.With(zap.String("db_path", s.DBPath))
+
+	if w.Bytes > 0 {
+		if f, err := os.Open(s.DBPath); err == nil {
+			_, err = io.CopyN(io.Discard, f, w.Bytes)
+			f.Close()
+			if err != nil && err != io.EOF {
+				logger.Warn("warming up page cache", zap.Error(err))
+			}
+		}
+	}
+
+	query := w.Query
+	if query == "" {
+		query = "SELECT count(*) FROM files"
+	}
+	if err := drain(s.db.Query(query)); err != nil {
+		logger.Warn("running warm-up query", zap.String("query", query), zap.Error(err))
+	}
+
+	if w.HotFiles > 0 {
+		if ok, _ := tableExists(s.db, "hits"); ok {
+			err := drain(s.db.Query(`SELECT f.content FROM files f JOIN (
+				SELECT name FROM hits WHERE hour >= ? GROUP BY name ORDER BY sum(count) DESC LIMIT ?
+			) h ON f.name = h.name`, time.Now().Add(-7*24*time.Hour).Unix(), w.HotFiles))
+			if err != nil {
+				logger.Warn("loading hot files", zap.Error(err))
+			}
+		}
+	}
+	logger.Debug("warmed up", zap.Duration("duration", time.Since(start)))
+}
+
+// drain reads and discards every row of rows.
+func drain(rows *sql.Rows, err error) error {
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	dest := make([]any, len(cols))
+	for i := range dest {
+		dest[i] = new(sql.RawBytes)
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,395 @@
+package sqlitefs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteOptions are the metadata of a file written with WriteFileContext.
+type WriteOptions struct {
+	// Default: 0644.
+	Mode fs.FileMode
+
+	// Default: the time of the write.
+	Modified time.Time
+
+	// When the file expires. Default: never.
+	ExpiredAt time.Time
+
+	// Write a variant of the file rather than the fallback row, in a files
+	// table with a variant column.
+	Variant string
+
+	// An If-Match header value the stored file must match, see
+	// checkIfMatch.
+	IfMatch string
+
+	// The media type to serve the file as, in a files table with a
+	// content_type column. Default: the type of its extension.
+	ContentType string
+}
+
+// WriteFile implements the os.WriteFile style of writing name.
+func (s SQLiteFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	_, err := s.WriteFileContext(context.Background(), name, data, WriteOptions{Mode: perm})
+	return err
+}
+
+// WriteFileContext creates or replaces the file name with content for the
+// tenant, dataset and variant of ctx and opts, and returns its new ETag.
+// In a files table with a version column every write adds a version.
+// Writes are checked against UploadPolicy, If-Match, the quotas and
+// RequireIfMatch, and fail with the error of the check.
+func (s SQLiteFS) WriteFileContext(ctx context.Context, name string, content []byte, opts WriteOptions) (string, error) {
+	if m, rest := s.mounted(name); m != nil {
+		return m.fsys.WriteFileContext(ctx, rest, content, opts)
+	}
+	if s.pool != nil {
+		fsys, err := s.pool.get(ctx)
+		if err != nil {
+			return "", err
+		}
+		return fsys.WriteFileContext(ctx, name, content, opts)
+	}
+	if err := s.checkWritable(name); err != nil {
+		return "", err
+	}
+	if opts.Variant != "" && !s.columns["variant"] {
+		return "", fmt.Errorf("writing %s: files table of %s has no variant column", name, s.DBPath)
+	}
+	if opts.ContentType != "" {
+		if !s.columns["content_type"] {
+			return "", fmt.Errorf("writing %s: files table of %s has no content_type column", name, s.DBPath)
+		}
+		if _, _, err := mime.ParseMediaType(opts.ContentType); err != nil {
+			return "", fmt.Errorf("writing %s: content type %q: %w", name, opts.ContentType, fs.ErrInvalid)
+		}
+	}
+	if err := s.checkUpload(ctx, name, opts.ContentType, content); err != nil {
+		return "", err
+	}
+	// checked by the name it is served by, stored by its name in the table
+	name = s.rootName(name)
+	key, err := s.writeKey(ctx, opts.Variant)
+	if err != nil {
+		return "", fmt.Errorf("writing %s: %w", name, err)
+	}
+	if opts.Mode == 0 {
+		opts.Mode = 0o644
+	}
+	if opts.Modified.IsZero() {
+		opts.Modified = time.Now()
+	}
+	var expiredAt *int64
+	if !opts.ExpiredAt.IsZero() {
+		ts := opts.ExpiredAt.Unix()
+		expiredAt = &ts
+	}
+	stored := content
+	chunked := s.ChunkSize > 0 && int64(len(content)) > s.ChunkSize && s.columns["chunks"]
+	var compression *string
+	if s.Compression != "" && s.columns["compression"] && !chunked {
+		compressed, err := compress(s.Compression, content)
+		if err != nil {
+			return "", fmt.Errorf("writing %s: %w", name, err)
+		}
+		// content that doesn't shrink, such as images, is kept as it is
+		if len(compressed) < len(content) {
+			stored, compression = compressed, &s.Compression
+		}
+	}
+	if s.ContentEncoding == "base64" && !s.columns["encoding"] && !chunked {
+		// pieces are served as they are
+		stored = []byte(base64.StdEncoding.EncodeToString(stored))
+	}
+
+	var hash, tag string
+	if s.columns["integrity"] {
+		// known now, and the ETag then changes with the content
+		hash = integrityOf(content)
+	}
+	if s.columns["etag"] {
+		tag = contentETag(content)
+	}
+
+	where, whereArgs := key.where(name)
+	err = withWriteTx(ctx, s.db, func(tx *sql.Tx) error {
+		if err := s.checkIfMatch(ctx, tx, name, opts.IfMatch); err != nil {
+			return err
+		}
+		var oldSize *int64
+		var deleted bool
+		err := tx.QueryRowContext(ctx, "SELECT "+s.sizeColumn()+", NOT ("+s.notDeleted()+") FROM files WHERE "+where+" LIMIT 1", whereArgs...).Scan(&oldSize, &deleted)
+		exists := err == nil
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		addBytes, addFiles := int64(len(stored)), int64(1)
+		// soft deleted rows don't count toward the quotas, so replacing
+		// one adds a file
+		if exists && !deleted {
+			addFiles = 0
+			if oldSize != nil && !s.columns["version"] {
+				addBytes -= *oldSize
+			}
+		}
+		if err := s.checkStorageQuota(ctx, tx, key, name, addBytes, addFiles); err != nil {
+			return err
+		}
+		if s.TenantColumn != "" {
+			if err := s.checkTenantQuota(ctx, tx, key.tenant, addBytes, addFiles); err != nil {
+				return err
+			}
+		}
+		if s.tenantUsage != nil {
+			defer s.tenantUsage.invalidate(key.tenant)
+		}
+
+		var chunks *string
+		if chunked {
+			id, err := s.writeChunks(ctx, tx, stored)
+			if err != nil {
+				return err
+			}
+			chunks = &id
+		}
+		set := []string{"content", "modified", "mode", "expired_at"}
+		vals := []any{stored, opts.Modified.Unix(), int64(opts.Mode), expiredAt}
+		if chunked {
+			vals[0] = nil
+		}
+		if s.columns["chunks"] {
+			// the trigger deletes the pieces replaced
+			set, vals = append(set, "chunks"), append(vals, chunks)
+		}
+		if s.columns["encoding"] {
+			set, vals = append(set, "encoding"), append(vals, "raw")
+		}
+		if s.columns["compression"] {
+			set, vals = append(set, "compression"), append(vals, compression)
+		}
+		if s.columns["content_type"] {
+			var contentType *string
+			if opts.ContentType != "" {
+				contentType = &opts.ContentType
+			}
+			set, vals = append(set, "content_type"), append(vals, contentType)
+		}
+		if s.columns["integrity"] {
+			set, vals = append(set, "integrity"), append(vals, hash)
+		}
+		if s.columns["etag"] {
+			set, vals = append(set, "etag"), append(vals, tag)
+		}
+		if exists && !s.columns["version"] {
+			assign := make([]string, len(set))
+			for i, col := range set {
+				assign[i] = col + "=?"
+			}
+			// the content is here now, and not deleted
+			for _, col := range []string{"external", "deleted_at"} {
+				if s.columns[col] {
+					assign = append(assign, col+"=NULL")
+				}
+			}
+			_, err := tx.ExecContext(ctx, "UPDATE files SET "+strings.Join(assign, ", ")+" WHERE "+where, append(vals, whereArgs...)...)
+			return err
+		}
+
+		cols := append([]string{"name"}, set...)
+		vals = append([]any{name}, vals...)
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ")
+		for i, col := range key.cols {
+			cols, vals = append(cols, quoteIdent(col)), append(vals, key.vals[i])
+			placeholders += ", ?"
+		}
+		if s.columns["version"] {
+			cols = append(cols, "version")
+			placeholders += ", (SELECT coalesce(max(version), 0) + 1 FROM files WHERE " + where + ")"
+			vals = append(vals, whereArgs...)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO files ("+strings.Join(cols, ", ")+") VALUES ("+placeholders+")", vals...)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if s.memCache != nil {
+		s.memCache.clear()
+	}
+	return sqliteFileInfo{size: int64(len(content)), modTime: time.Unix(opts.Modified.Unix(), 0), hash: hash, tag: storedETag(tag)}.etag(), nil
+}
+
+// Remove deletes the file name.
+func (s SQLiteFS) Remove(name string) error {
+	return s.RemoveContext(context.Background(), name, "")
+}
+
+// RemoveContext deletes all rows of name of the tenant and dataset of ctx,
+// every version and variant, if the current one matches ifMatch. With a
+// deleted_at column they are soft deleted and can be restored.
+func (s SQLiteFS) RemoveContext(ctx context.Context, name, ifMatch string) error {
+	if m, rest := s.mounted(name); m != nil {
+		return m.fsys.RemoveContext(ctx, rest, ifMatch)
+	}
+	if s.pool != nil {
+		fsys, err := s.pool.get(ctx)
+		if err != nil {
+			return err
+		}
+		return fsys.RemoveContext(ctx, name, ifMatch)
+	}
+	if err := s.checkWritable(name); err != nil {
+		return err
+	}
+	name = s.rootName(name)
+	key, err := s.writeKey(ctx, "")
+	if err != nil {
+		return fmt.Errorf("removing %s: %w", name, err)
+	}
+	// not the variant, so all of them go
+	key.variant = false
+	where, whereArgs := key.where(name)
+	err = withWriteTx(ctx, s.db, func(tx *sql.Tx) error {
+		if err := s.checkIfMatch(ctx, tx, name, ifMatch); err != nil {
+			return err
+		}
+		var res sql.Result
+		var err error
+		if s.columns["deleted_at"] {
+			res, err = tx.ExecContext(ctx, "UPDATE files SET deleted_at=strftime('%s','now') WHERE deleted_at IS NULL AND "+where, whereArgs...)
+		} else {
+			res, err = tx.ExecContext(ctx, "DELETE FROM files WHERE "+where, whereArgs...)
+		}
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if s.tenantUsage != nil {
+		s.tenantUsage.invalidate(key.tenant)
+	}
+	if s.memCache != nil {
+		s.memCache.clear()
+	}
+	return nil
+}
+
+// checkWritable returns an error if name can't be written.
+func (s SQLiteFS) checkWritable(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	if !s.nameAllowed(name) {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	if _, ok := s.VirtualFiles[name]; ok {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrPermission}
+	}
+	if err := s.usable(); err != nil {
+		return err
+	}
+	if s.readOnly {
+		return fmt.Errorf("%s is opened read-only: %w", s.DBPath, fs.ErrPermission)
+	}
+	if s.mapsLayout() {
+		return fmt.Errorf("%s is served through a view of its table: %w", s.DBPath, fs.ErrPermission)
+	}
+	return nil
+}
+
+// writeKey is the value of each column that tells apart the rows of a name
+// which a write goes to, other than the version.
+type writeKey struct {
+	cols []string
+	vals []any // nil for NULL
+
+	tenant  string
+	variant bool // whether the variant column is among cols
+}
+
+// writeKey returns the key of the rows that writes for ctx change: those
+// of its tenant and the active dataset, and of variant or the fallback.
+func (s SQLiteFS) writeKey(ctx context.Context, variant string) (writeKey, error) {
+	var k writeKey
+	if s.TenantColumn != "" {
+		k.tenant = s.tenant(ctx)
+		if k.tenant == "" {
+			return k, fmt.Errorf("no tenant: %w", fs.ErrPermission)
+		}
+		k.cols, k.vals = append(k.cols, s.TenantColumn), append(k.vals, k.tenant)
+	}
+	if s.columns["dataset"] {
+		var label any
+		if l := s.activeDataset(); l != "" {
+			label = l
+		}
+		k.cols, k.vals = append(k.cols, "dataset"), append(k.vals, label)
+	}
+	if s.columns["variant"] {
+		var v any
+		if variant != "" {
+			v = variant
+		}
+		k.cols, k.vals = append(k.cols, "variant"), append(k.vals, v)
+		k.variant = true
+	}
+	return k, nil
+}
+
+// where returns the condition matching the rows of name with this key.
+func (k writeKey) where(name string) (string, []any) {
+	conds, args := []string{"name=?"}, []any{name}
+	for i, col := range k.cols {
+		if col == "variant" && !k.variant {
+			continue
+		}
+		if k.vals[i] == nil {
+			conds = append(conds, quoteIdent(col)+" IS NULL")
+		} else {
+			conds, args = append(conds, quoteIdent(col)+"=?"), append(args, k.vals[i])
+		}
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// scope returns the condition matching the rows of all names with this
+// key, of every variant.
+func (k writeKey) scope() (string, []any) {
+	var conds []string
+	var args []any
+	for i, col := range k.cols {
+		if col == "variant" {
+			continue
+		}
+		if k.vals[i] == nil {
+			conds = append(conds, quoteIdent(col)+" IS NULL")
+		} else {
+			conds, args = append(conds, quoteIdent(col)+"=?"), append(args, k.vals[i])
+		}
+	}
+	if len(conds) == 0 {
+		return "1", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// versionTag returns the If-Match value that matches version, for files
+// tables with a version column.
+func versionTag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}